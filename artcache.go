@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dhowden/tag"
+)
+
+// ArtCache extracts cover art to $XDG_CACHE_HOME/moc-mpris-bridge, so
+// that clients get a short file:// URL instead of the whole picture.
+// Files are named after the hash of the picture, and every album is
+// only extracted once. The art comes from the first provider of the
+// chain that has a picture; slow providers are queried in the
+// background, and their results are delivered by Results.
+type ArtCache struct {
+	dir       string
+	maxSize   int
+	maxBytes  int64
+	providers []ArtProvider
+	albums    map[string]string
+
+	// albums being looked up in the background, and when to look up
+	// again the albums that weren't found
+	pending map[string]bool
+	misses  map[string]time.Time
+	lookups chan artLookup
+	results chan ArtResult
+}
+
+type artLookup struct {
+	album     string
+	track     ArtTrack
+	providers []ArtProvider
+}
+
+// ArtResult is the outcome of a background lookup
+type ArtResult struct {
+	album string
+	pic   *tag.Picture
+	err   error
+}
+
+// lookups failing or finding nothing are retried after these delays
+const (
+	artErrorRetry = 10 * time.Minute
+	artMissRetry  = 24 * time.Hour
+)
+
+func NewArtCache(cfg *Config) *ArtCache {
+	cache := &ArtCache{}
+	cache.albums = make(map[string]string)
+	cache.pending = make(map[string]bool)
+	cache.results = make(chan ArtResult, 16)
+	cache.configure(cfg)
+	if dir, err := os.UserCacheDir(); err == nil {
+		cache.dir = filepath.Join(dir, "moc-mpris-bridge")
+	}
+	return cache
+}
+
+// configure applies the art options of cfg. Albums without art are
+// looked up again, in case the new providers find some; lookups
+// already queued keep the providers they started with.
+func (c *ArtCache) configure(cfg *Config) {
+	c.maxSize = cfg.ArtMaxSize
+	c.maxBytes = int64(cfg.ArtCacheSize) * 1024 * 1024
+	c.misses = make(map[string]time.Time)
+	c.providers = nil
+	for _, name := range cfg.ArtProviders {
+		provider, err := newArtProvider(name, cfg)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		c.providers = append(c.providers, provider)
+	}
+}
+
+// URL returns the file:// URL of the art of album. If the album wasn't
+// seen before, the providers are asked for the picture of track. It
+// returns "" if there is no picture, it can't be stored, or a slow
+// provider is still looking for it.
+func (c *ArtCache) URL(album string, track ArtTrack) string {
+	if c == nil || c.dir == "" {
+		return ""
+	}
+	if path, ok := c.albums[album]; ok {
+		// keep recently used art from being evicted
+		if err := touch(path); err == nil {
+			return fileURL(path)
+		}
+		delete(c.albums, album)
+	}
+	if c.pending[album] || time.Now().Before(c.misses[album]) {
+		return ""
+	}
+
+	for i, provider := range c.providers {
+		if provider.Slow() {
+			c.lookup(artLookup{album: album, track: track, providers: c.providers[i:]})
+			return ""
+		}
+		pic, err := provider.Art(track)
+		if err != nil {
+			log.Printf("couldn't get album art: %v", err)
+			continue
+		}
+		if pic != nil && len(pic.Data) > 0 {
+			return c.add(album, pic)
+		}
+	}
+	return ""
+}
+
+// Results delivers the outcome of the background lookups, which must
+// be handed to Complete
+func (c *ArtCache) Results() <-chan ArtResult {
+	if c == nil {
+		return nil
+	}
+	return c.results
+}
+
+// Complete stores the picture found by a background lookup, and
+// returns its URL. Lookups finding nothing are remembered, so that
+// they aren't repeated for every track of the album.
+func (c *ArtCache) Complete(res ArtResult) string {
+	delete(c.pending, res.album)
+	if res.err != nil {
+		log.Printf("couldn't get album art: %v", res.err)
+		c.misses[res.album] = time.Now().Add(artErrorRetry)
+		return ""
+	}
+	if res.pic == nil || len(res.pic.Data) == 0 {
+		c.misses[res.album] = time.Now().Add(artMissRetry)
+		return ""
+	}
+	delete(c.misses, res.album)
+	return c.add(res.album, res.pic)
+}
+
+// lookup queues a background lookup. Lookups run one at a time, as
+// remote services limit the rate of requests anyway.
+func (c *ArtCache) lookup(l artLookup) {
+	if c.lookups == nil {
+		c.lookups = make(chan artLookup, 16)
+		go c.work()
+	}
+	select {
+	case c.lookups <- l:
+		c.pending[l.album] = true
+	default:
+		// too many pending lookups, try again with a later track
+	}
+}
+
+func (c *ArtCache) work() {
+	for l := range c.lookups {
+		res := ArtResult{album: l.album}
+		for _, provider := range l.providers {
+			pic, err := provider.Art(l.track)
+			if err != nil {
+				res.err = err
+				continue
+			}
+			if pic != nil && len(pic.Data) > 0 {
+				res.pic, res.err = pic, nil
+				break
+			}
+		}
+		c.results <- res
+	}
+}
+
+func (c *ArtCache) add(album string, pic *tag.Picture) string {
+	path, err := c.store(pic)
+	if err != nil {
+		log.Printf("couldn't cache album art: %v", err)
+		return ""
+	}
+	c.albums[album] = path
+	c.evict()
+	return fileURL(path)
+}
+
+func (c *ArtCache) store(pic *tag.Picture) (string, error) {
+	sum := sha256.Sum256(pic.Data)
+	name := hex.EncodeToString(sum[:16])
+	if c.maxSize > 0 {
+		name = fmt.Sprintf("%s-%d", name, c.maxSize)
+	}
+	// the extension depends on the scaling, which is only done once
+	for _, ext := range artExts {
+		path := filepath.Join(c.dir, name+ext)
+		if err := touch(path); err == nil {
+			return path, nil
+		}
+	}
+
+	data, ext := pic.Data, pictureExt(pic)
+	if c.maxSize > 0 {
+		// formats that can't be decoded are kept as they are
+		scaled, scaledExt, err := downscale(pic.Data, c.maxSize)
+		if err == nil && scaled != nil {
+			data, ext = scaled, scaledExt
+		}
+	}
+
+	path := filepath.Join(c.dir, name+ext)
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return "", err
+	}
+	// write atomically, clients may read it at any time
+	tmp, err := os.CreateTemp(c.dir, ".art-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
+
+// evict removes the least recently used pictures while the cache is
+// bigger than its limit
+func (c *ArtCache) evict() {
+	if c.maxBytes <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+	slices.SortFunc(files, func(a, b os.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+	for _, info := range files {
+		if total <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, info.Name())); err != nil {
+			continue
+		}
+		total -= info.Size()
+	}
+}
+
+// downscale scales the picture down so that its longest side is at
+// most maxSize pixels. It returns nil if the picture is small enough.
+func downscale(data []byte, maxSize int) ([]byte, string, error) {
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if max(w, h) <= maxSize {
+		return nil, "", nil
+	}
+	if w >= h {
+		w, h = maxSize, max(h*maxSize/w, 1)
+	} else {
+		w, h = max(w*maxSize/h, 1), maxSize
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	boxScale(dst, src)
+
+	var buf bytes.Buffer
+	if format == "png" {
+		err = png.Encode(&buf, dst)
+		return buf.Bytes(), ".png", err
+	}
+	err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 90})
+	return buf.Bytes(), ".jpg", err
+}
+
+// boxScale averages the source pixels covered by every pixel of dst
+func boxScale(dst *image.RGBA, src image.Image) {
+	sb, db := src.Bounds(), dst.Bounds()
+	for y := 0; y < db.Dy(); y++ {
+		y0 := sb.Min.Y + y*sb.Dy()/db.Dy()
+		y1 := max(sb.Min.Y+(y+1)*sb.Dy()/db.Dy(), y0+1)
+		for x := 0; x < db.Dx(); x++ {
+			x0 := sb.Min.X + x*sb.Dx()/db.Dx()
+			x1 := max(sb.Min.X+(x+1)*sb.Dx()/db.Dx(), x0+1)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+}
+
+// extensions of the cached pictures, as given by pictureExt and
+// downscale
+var artExts = []string{".jpg", ".png", ".gif", ".webp", ".bmp"}
+
+func pictureExt(pic *tag.Picture) string {
+	switch strings.ToLower(pic.MIMEType) {
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	case "image/bmp":
+		return ".bmp"
+	}
+	return ".jpg"
+}
+
+// touch updates the modification time of path, used to evict the
+// least recently used pictures. It fails if path doesn't exist.
+func touch(path string) error {
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+func fileURL(path string) string {
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dhowden/tag"
+)
+
+func TestStore(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 20))); err != nil {
+		t.Fatal(err)
+	}
+	pic := &tag.Picture{MIMEType: "image/png", Data: buf.Bytes()}
+	c := &ArtCache{dir: t.TempDir(), maxSize: 10}
+
+	path, err := c.store(pic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(path, "-10.png") {
+		t.Errorf("stored as %s", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scaled, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := scaled.Bounds().Size(); size != image.Pt(10, 5) {
+		t.Errorf("scaled to %v", size)
+	}
+
+	// the picture is found again whatever its extension, without
+	// scaling it
+	other := strings.TrimSuffix(path, ".png") + ".jpg"
+	if err := os.Rename(path, other); err != nil {
+		t.Fatal(err)
+	}
+	again, err := c.store(pic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != other {
+		t.Errorf("stored again as %s, want %s", again, other)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("%d files in the cache", len(entries))
+	}
+}
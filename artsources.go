@@ -0,0 +1,287 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dhowden/tag"
+)
+
+// pictures bigger than this are ignored
+const maxArtSize = 20 * 1024 * 1024
+
+// directories of multi-disc albums, such as "CD1" or "Disc 2"
+var discDirRegexp = regexp.MustCompile(`(?i)^(cd|dis[ck])[ _-]*\d+\b`)
+
+// ArtTrack describes the track whose cover art is looked for
+type ArtTrack struct {
+	File   string
+	Artist string
+	Album  string
+
+	// picture embedded in the file, if any
+	embedded *tag.Picture
+}
+
+// ArtProvider is a source of cover art. Art returns nil if the
+// provider has no picture for the track. Slow providers are queried in
+// the background, so that metadata is never delayed by them.
+type ArtProvider interface {
+	Art(track ArtTrack) (*tag.Picture, error)
+	Slow() bool
+}
+
+// newArtProvider returns the provider called name in the config
+func newArtProvider(name string, cfg *Config) (ArtProvider, error) {
+	switch strings.ToLower(name) {
+	case "embedded":
+		return EmbeddedArt{}, nil
+	case "folder":
+		return FolderArt{patterns: cfg.ArtFiles}, nil
+	case "musicbrainz":
+		return NewMusicBrainzArt(cfg.MusicBrainzURL, cfg.CoverArtArchiveURL), nil
+	}
+	return nil, fmt.Errorf("unknown art provider %q", name)
+}
+
+// EmbeddedArt provides the picture embedded in the file
+type EmbeddedArt struct{}
+
+func (EmbeddedArt) Art(track ArtTrack) (*tag.Picture, error) {
+	return track.embedded, nil
+}
+
+func (EmbeddedArt) Slow() bool {
+	return false
+}
+
+// FolderArt provides the first image next to the file matching one of
+// its patterns. The parent directory is searched too when the file is
+// in a disc directory of a multi-disc album.
+type FolderArt struct {
+	patterns []string
+}
+
+func (f FolderArt) Art(track ArtTrack) (*tag.Picture, error) {
+	if isStream(track.File) {
+		return nil, nil
+	}
+	dir := filepath.Dir(track.File)
+	if pic := folderImage(dir, f.patterns); pic != nil {
+		return pic, nil
+	}
+	if discDirRegexp.MatchString(filepath.Base(dir)) {
+		return folderImage(filepath.Dir(dir), f.patterns), nil
+	}
+	return nil, nil
+}
+
+func (FolderArt) Slow() bool {
+	return false
+}
+
+// MusicBrainzArt looks the release group of the album up on
+// MusicBrainz, and fetches its front cover from the Cover Art Archive.
+// Only one lookup runs at a time, and at most one per second, as the
+// MusicBrainz rate limit asks.
+type MusicBrainzArt struct {
+	client         *http.Client
+	musicBrainzURL string
+	coverArtURL    string
+	last           time.Time
+}
+
+func NewMusicBrainzArt(musicBrainzURL, coverArtURL string) *MusicBrainzArt {
+	mb := &MusicBrainzArt{}
+	mb.client = &http.Client{Timeout: 15 * time.Second}
+	mb.musicBrainzURL = strings.TrimSuffix(musicBrainzURL, "/")
+	mb.coverArtURL = strings.TrimSuffix(coverArtURL, "/")
+	return mb
+}
+
+func (mb *MusicBrainzArt) Art(track ArtTrack) (*tag.Picture, error) {
+	if track.Artist == "" || track.Album == "" {
+		return nil, nil
+	}
+	id, err := mb.releaseGroup(track.Artist, track.Album)
+	if err != nil || id == "" {
+		return nil, err
+	}
+	resp, err := mb.get(fmt.Sprintf("%s/release-group/%s/front-500", mb.coverArtURL, url.PathEscape(id)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cover art archive: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxArtSize+1))
+	if err != nil {
+		return nil, err
+	}
+	return imagePicture(data, ""), nil
+}
+
+func (*MusicBrainzArt) Slow() bool {
+	return true
+}
+
+// releaseGroup returns the id of the release group best matching the
+// album, or "" if there is no good match
+func (mb *MusicBrainzArt) releaseGroup(artist, album string) (string, error) {
+	query := url.Values{}
+	query.Set("query", fmt.Sprintf("releasegroup:%s AND artist:%s", luceneQuote(album), luceneQuote(artist)))
+	query.Set("limit", "1")
+	query.Set("fmt", "json")
+	resp, err := mb.get(mb.musicBrainzURL + "/ws/2/release-group/?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("musicbrainz: %s", resp.Status)
+	}
+
+	var result struct {
+		ReleaseGroups []struct {
+			ID    string `json:"id"`
+			Score int    `json:"score"`
+		} `json:"release-groups"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("musicbrainz: %w", err)
+	}
+	// search results always come back, however poor the match
+	if len(result.ReleaseGroups) == 0 || result.ReleaseGroups[0].Score < 90 {
+		return "", nil
+	}
+	return result.ReleaseGroups[0].ID, nil
+}
+
+func (mb *MusicBrainzArt) get(u string) (*http.Response, error) {
+	if wait := time.Second - time.Since(mb.last); wait > 0 {
+		time.Sleep(wait)
+	}
+	mb.last = time.Now()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	// MusicBrainz rejects anonymous clients
+	req.Header.Set("User-Agent", fmt.Sprintf("moc-mpris-bridge/%s ( https://github.com/azr4e1/moc-mpris-bridge )", VERSION))
+	req.Header.Set("Accept", "application/json")
+	return mb.client.Do(req)
+}
+
+// luceneQuote quotes s as a phrase of a MusicBrainz search query
+func luceneQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// folderImage returns the first image of dir matching one of the
+// patterns, which are tried in order and matched case-insensitively
+func folderImage(dir string, patterns []string) *tag.Picture {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			match, err := filepath.Match(pattern, strings.ToLower(entry.Name()))
+			if err != nil || !match {
+				continue
+			}
+			if pic := readImage(filepath.Join(dir, entry.Name())); pic != nil {
+				return pic
+			}
+		}
+	}
+	return nil
+}
+
+// readImage reads path if its content is an image
+func readImage(path string) *tag.Picture {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer fd.Close()
+	data, err := io.ReadAll(io.LimitReader(fd, maxArtSize+1))
+	if err != nil {
+		return nil
+	}
+	return imagePicture(data, strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+// imagePicture makes a front cover out of data, if its content is an
+// image of a reasonable size
+func imagePicture(data []byte, ext string) *tag.Picture {
+	if len(data) > maxArtSize {
+		return nil
+	}
+	mimeType := http.DetectContentType(data)
+	if !strings.HasPrefix(mimeType, "image/") {
+		return nil
+	}
+	return &tag.Picture{
+		Ext:      ext,
+		MIMEType: mimeType,
+		Type:     "Cover (front)",
+		Data:     data,
+	}
+}
+
+// frontCover returns the front cover among the pictures embedded in
+// a file, and the first picture otherwise
+func frontCover(pictures []*tag.Picture) *tag.Picture {
+	for _, pic := range pictures {
+		if pic.Type == "Cover (front)" {
+			return pic
+		}
+	}
+	if len(pictures) > 0 {
+		return pictures[0]
+	}
+	return nil
+}
+
+// embeddedPictures returns the pictures embedded in file, in the order
+// of its tag
+func embeddedPictures(file string, m tag.Metadata) []*tag.Picture {
+	if m.FileType() == tag.FLAC {
+		return readFLACPictures(file)
+	}
+	// repeated frames are APIC, APIC_0, APIC_1...: shorter keys first
+	raw := m.Raw()
+	keys := slices.SortedFunc(maps.Keys(raw), func(a, b string) int {
+		return cmp.Or(cmp.Compare(len(a), len(b)), strings.Compare(a, b))
+	})
+	var pictures []*tag.Picture
+	for _, key := range keys {
+		if pic, ok := raw[key].(*tag.Picture); ok {
+			pictures = append(pictures, pic)
+		}
+	}
+	if len(pictures) == 0 && m.Picture() != nil {
+		pictures = append(pictures, m.Picture())
+	}
+	return pictures
+}
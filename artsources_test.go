@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dhowden/tag"
+)
+
+// flacPictureBlock encodes a PICTURE metadata block
+func flacPictureBlock(pictureType uint32, data string, last bool) []byte {
+	var body bytes.Buffer
+	field := func(s string) {
+		binary.Write(&body, binary.BigEndian, uint32(len(s)))
+		body.WriteString(s)
+	}
+	binary.Write(&body, binary.BigEndian, pictureType)
+	field("image/png")
+	field("")
+	body.Write(make([]byte, 16))
+	field(data)
+
+	header := []byte{6, byte(body.Len() >> 16), byte(body.Len() >> 8), byte(body.Len())}
+	if last {
+		header[0] |= 0x80
+	}
+	return append(header, body.Bytes()...)
+}
+
+// id3PictureFrame encodes an ID3v2.3 APIC frame
+func id3PictureFrame(pictureType byte, data string) []byte {
+	body := append([]byte("\x00image/png\x00"), pictureType, 0)
+	body = append(body, data...)
+	frame := []byte("APIC")
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(body)))
+	frame = append(frame, 0, 0)
+	return append(frame, body...)
+}
+
+func TestEmbeddedPictures(t *testing.T) {
+	streamInfo := append([]byte{0, 0, 0, 34}, make([]byte, 34)...)
+	flac := append([]byte("fLaC"), streamInfo...)
+	flac = append(flac, flacPictureBlock(0, "other", false)...)
+	flac = append(flac, flacPictureBlock(3, "front", false)...)
+	flac = append(flac, flacPictureBlock(4, "back", true)...)
+
+	var frames []byte
+	frames = append(frames, id3PictureFrame(0, "first")...)
+	frames = append(frames, id3PictureFrame(4, "second")...)
+	for range 10 {
+		frames = append(frames, id3PictureFrame(5, "leaflet")...)
+	}
+	frames = append(frames, id3PictureFrame(6, "last")...)
+	size := len(frames)
+	mp3 := []byte{'I', 'D', '3', 3, 0, 0, byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	mp3 = append(mp3, frames...)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		first string
+		last  string
+		front string
+	}{
+		{"flac.flac", flac, "other", "back", "front"},
+		{"id3.mp3", mp3, "first", "last", "first"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), tt.name)
+			if err := os.WriteFile(file, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			fd, err := os.Open(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fd.Close()
+			m, err := tag.ReadFrom(fd)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pictures := embeddedPictures(file, m)
+			if len(pictures) < 2 {
+				t.Fatalf("got %d pictures", len(pictures))
+			}
+			if got := string(pictures[0].Data); got != tt.first {
+				t.Errorf("first picture %q, want %q", got, tt.first)
+			}
+			if got := string(pictures[len(pictures)-1].Data); got != tt.last {
+				t.Errorf("last picture %q, want %q", got, tt.last)
+			}
+			if got := string(frontCover(pictures).Data); got != tt.front {
+				t.Errorf("front cover %q, want %q", got, tt.front)
+			}
+		})
+	}
+}
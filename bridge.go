@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/godbus/dbus/v5/prop"
+)
+
+// updates failing in a row are retried after a delay doubling from
+// minBackoff up to maxBackoff
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// the same error is logged at most this often
+const errorLogInterval = time.Minute
+
+// stuckCommands counts the external commands and MOC requests that
+// timed out, and the D-Bus calls the loop didn't answer in time
+var stuckCommands atomic.Uint32
+
+// Bridge serves org.moc_mpris_bridge.Bridge, which tells how the
+// bridge itself is doing. Failing updates don't stop the bridge: they
+// are counted here, and the last good state stays published.
+type Bridge struct {
+	properties *Properties
+	propValues map[string]any
+	failures   uint32
+	lastError  string
+	lastFailed time.Time
+}
+
+func NewBridge() (*Bridge, error) {
+	return &Bridge{}, nil
+}
+
+// props returns the properties of org.moc_mpris_bridge.Bridge, and
+// records their values as published
+func (b *Bridge) props() map[string]*prop.Prop {
+	b.propValues = b.values()
+	props := make(map[string]*prop.Prop)
+	for name, value := range b.propValues {
+		props[name] = newProp(value, nil)
+	}
+	return props
+}
+
+func (b *Bridge) values() map[string]any {
+	var lastFailed int64
+	if !b.lastFailed.IsZero() {
+		lastFailed = b.lastFailed.Unix()
+	}
+	return map[string]any{
+		"Status":        b.Status(),
+		"LastError":     b.lastError,
+		"LastErrorTime": lastFailed,
+		"FailedUpdates": b.failures,
+		"StuckCommands": stuckCommands.Load(),
+		"Version":       VERSION,
+	}
+}
+
+// Status is "ok" while updates succeed, and "degraded" followed by the
+// last error while they fail
+func (b *Bridge) Status() string {
+	if b.failures == 0 {
+		return "ok"
+	}
+	return fmt.Sprintf("degraded: %s", b.lastError)
+}
+
+// succeeded records a successful update
+func (b *Bridge) succeeded() error {
+	if b.failures > 0 {
+		log.Printf("updates recovered after %d failures", b.failures)
+	}
+	b.failures = 0
+	return b.update()
+}
+
+// failed records a failed update, and returns how long to wait before
+// trying again
+func (b *Bridge) failed(err error) (time.Duration, error) {
+	b.failures++
+	b.lastError = err.Error()
+	b.lastFailed = time.Now()
+	limitedLog.Printf("update failed: %v", err)
+
+	backoff := minBackoff
+	for i := uint32(1); i < b.failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff), b.update()
+}
+
+// update announces the properties whose value changed
+func (b *Bridge) update() error {
+	_, err := b.properties.publishChanged("org.moc_mpris_bridge.Bridge", b.propValues, b.values())
+	return err
+}
+
+// logLimiter logs every message at most once per errorLogInterval, and
+// tells how many times it was left out
+type logLimiter struct {
+	mu         sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+var limitedLog = &logLimiter{
+	last:       make(map[string]time.Time),
+	suppressed: make(map[string]int),
+}
+
+func (l *logLimiter) Printf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.last[msg]) < errorLogInterval {
+		l.suppressed[msg]++
+		return
+	}
+	l.last[msg] = time.Now()
+	if n := l.suppressed[msg]; n > 0 {
+		log.Printf("%s (%d times since last logged)", msg, n)
+	} else {
+		log.Print(msg)
+	}
+	delete(l.suppressed, msg)
+	// forget the messages not seen for a while
+	for m, t := range l.last {
+		if time.Since(t) >= errorLogInterval && l.suppressed[m] == 0 {
+			delete(l.last, m)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings read from the configuration file. The
+// file uses the same "Key = Value" syntax as the MOC config; lists
+// are comma separated, and values may be double quoted to keep
+// leading or trailing spaces and commas.
+type Config struct {
+	// directories searched for m3u/pls playlists
+	PlaylistDirs []string
+	// separators splitting artists, genres and composers
+	ArtistSeparators []string
+	// longest side of cached cover art in pixels, 0 keeps the original
+	ArtMaxSize int
+	// size limit of the cover art cache in MiB, 0 for no limit
+	ArtCacheSize int
+	// cover art providers, tried in order
+	ArtProviders []string
+	// patterns of the cover images looked for next to the tracks
+	ArtFiles []string
+	// servers queried by the musicbrainz art provider
+	MusicBrainzURL     string
+	CoverArtArchiveURL string
+	// whether clients may quit mocp and the bridge
+	AllowQuit bool
+	// whether Play and OpenUri start the MOC server when it's down
+	StartServer bool
+	// shell command opening mocp, run by Raise
+	RaiseCommand string
+	// shell command focusing an open mocp, succeeding if it found one
+	FocusCommand string
+	// name of the desktop file shown by desktops, without .desktop
+	DesktopEntry string
+	// how often MOC is polled while playing, and at most how long
+	// polling backs off to while it's idle
+	PollInterval    time.Duration
+	MaxPollInterval time.Duration
+}
+
+func DefaultConfig() *Config {
+	cfg := &Config{
+		ArtistSeparators:   []string{";", "/", " feat. "},
+		ArtMaxSize:         0,
+		ArtCacheSize:       100,
+		ArtProviders:       []string{"embedded", "folder"},
+		ArtFiles:           []string{"cover.*", "folder.*", "front.*", "album.*", "albumart*"},
+		MusicBrainzURL:     "https://musicbrainz.org",
+		CoverArtArchiveURL: "https://coverartarchive.org",
+		AllowQuit:          true,
+		DesktopEntry:       "mocp",
+		PollInterval:       time.Second,
+		MaxPollInterval:    time.Minute,
+	}
+	if dir := mocMusicDir(); dir != "" {
+		cfg.PlaylistDirs = append(cfg.PlaylistDirs, dir)
+	}
+	if dir := MocDir(); dir != "" {
+		cfg.PlaylistDirs = append(cfg.PlaylistDirs, dir)
+	}
+	return cfg
+}
+
+// DefaultConfigPath returns $XDG_CONFIG_HOME/moc-mpris-bridge/config
+func DefaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "moc-mpris-bridge", "config")
+}
+
+// LoadConfig reads the configuration file at path. A missing file
+// is not an error: the defaults are used.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	values, err := readKeyValues(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for key, val := range values {
+		switch key {
+		case "PlaylistDirs":
+			list, err := parseList(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+			cfg.PlaylistDirs = nil
+			for _, dir := range list {
+				cfg.PlaylistDirs = append(cfg.PlaylistDirs, expandHome(dir))
+			}
+		case "ArtistSeparators":
+			cfg.ArtistSeparators, err = parseList(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+		case "ArtMaxSize":
+			cfg.ArtMaxSize, err = parseUint(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+		case "ArtCacheSize":
+			cfg.ArtCacheSize, err = parseUint(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+		case "ArtProviders":
+			cfg.ArtProviders, err = parseList(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+			for _, name := range cfg.ArtProviders {
+				if _, err := newArtProvider(name, cfg); err != nil {
+					return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+				}
+			}
+		case "MusicBrainzURL":
+			cfg.MusicBrainzURL, err = parseURL(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+		case "CoverArtArchiveURL":
+			cfg.CoverArtArchiveURL, err = parseURL(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+		case "AllowQuit":
+			cfg.AllowQuit, err = parseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+		case "StartServer":
+			cfg.StartServer, err = parseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+		case "RaiseCommand":
+			cfg.RaiseCommand = unquote(val)
+		case "FocusCommand":
+			cfg.FocusCommand = unquote(val)
+		case "DesktopEntry":
+			cfg.DesktopEntry = strings.TrimSuffix(unquote(val), ".desktop")
+		case "ArtFiles":
+			cfg.ArtFiles, err = parseList(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+			for _, pattern := range cfg.ArtFiles {
+				if _, err := filepath.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("%s: %s: %q: %w", path, key, pattern, err)
+				}
+			}
+		case "PollInterval":
+			cfg.PollInterval, err = parseInterval(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+		case "MaxPollInterval":
+			cfg.MaxPollInterval, err = parseInterval(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s: unknown option %q", path, key)
+		}
+	}
+	if cfg.MaxPollInterval < cfg.PollInterval {
+		return nil, fmt.Errorf("%s: MaxPollInterval is shorter than PollInterval", path)
+	}
+	return cfg, nil
+}
+
+// mocMusicDir returns the MusicDir option of the MOC config, if set
+func mocMusicDir() string {
+	values, err := readKeyValues(filepath.Join(MocDir(), "config"))
+	if err != nil {
+		return ""
+	}
+	dir := strings.Trim(values["MusicDir"], `"`)
+	if dir == "" {
+		return ""
+	}
+	return expandHome(dir)
+}
+
+// readKeyValues reads "Key = Value" lines, ignoring comments
+func readKeyValues(path string) (map[string]string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		values[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	return values, scanner.Err()
+}
+
+// parseList splits a comma separated list; double quoted items are
+// taken verbatim
+func parseList(val string) ([]string, error) {
+	var items []string
+	for rest := strings.TrimSpace(val); rest != ""; {
+		var item string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				return nil, errors.New("unterminated quote")
+			}
+			item = rest[1 : end+1]
+			after := strings.TrimSpace(rest[end+2:])
+			if after != "" && !strings.HasPrefix(after, ",") {
+				return nil, errors.New("missing comma after quoted item")
+			}
+			rest = strings.TrimPrefix(after, ",")
+		} else {
+			item, rest, _ = strings.Cut(rest, ",")
+			item = strings.TrimSpace(item)
+		}
+		rest = strings.TrimSpace(rest)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func parseUint(val string) (int, error) {
+	n, err := strconv.Atoi(strings.Trim(val, `"`))
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("must not be negative")
+	}
+	return n, nil
+}
+
+// parseInterval accepts a number of seconds, or a duration with its
+// unit such as 500ms or 2m
+func parseInterval(val string) (time.Duration, error) {
+	val = unquote(val)
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		seconds, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a duration", val)
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, errors.New("must be positive")
+	}
+	return d, nil
+}
+
+// parseBool accepts the yes/no of the MOC config, and true/false
+func parseBool(val string) (bool, error) {
+	switch strings.ToLower(unquote(val)) {
+	case "yes", "true", "1":
+		return true, nil
+	case "no", "false", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not yes or no", val)
+}
+
+// unquote removes the double quotes around a whole value
+func unquote(val string) string {
+	if len(val) >= 2 && strings.HasPrefix(val, `"`) && strings.HasSuffix(val, `"`) {
+		return val[1 : len(val)-1]
+	}
+	return val
+}
+
+// parseURL checks that val is an http(s) URL
+func parseURL(val string) (string, error) {
+	val = unquote(val)
+	u, err := url.Parse(val)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.New("must be an http or https URL")
+	}
+	return val, nil
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/dhowden/tag"
+)
+
+// readFLACPictures returns the pictures of a FLAC file, in the order of
+// its metadata blocks. The tag library only keeps the last one.
+// Pictures bigger than maxArtSize are skipped.
+func readFLACPictures(file string) []*tag.Picture {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer fd.Close()
+
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(fd, header[:4]); err != nil {
+		return nil
+	}
+	// an ID3v2 tag may come first
+	if string(header[:3]) == "ID3" {
+		if _, err := io.ReadFull(fd, header[4:]); err != nil {
+			return nil
+		}
+		if _, err := fd.Seek(int64(syncsafe(header[6:10])), io.SeekCurrent); err != nil {
+			return nil
+		}
+		if _, err := io.ReadFull(fd, header[:4]); err != nil {
+			return nil
+		}
+	}
+	if string(header[:4]) != "fLaC" {
+		return nil
+	}
+
+	var pictures []*tag.Picture
+	for last := false; !last; {
+		if _, err := io.ReadFull(fd, header[:4]); err != nil {
+			break
+		}
+		last = header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		size := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		if blockType != 6 {
+			if _, err := fd.Seek(int64(size), io.SeekCurrent); err != nil {
+				break
+			}
+			continue
+		}
+		block := make([]byte, size)
+		if _, err := io.ReadFull(fd, block); err != nil {
+			break
+		}
+		if pic := parseFLACPicture(block); pic != nil {
+			pictures = append(pictures, pic)
+		}
+	}
+	return pictures
+}
+
+// parseFLACPicture decodes a PICTURE metadata block
+func parseFLACPicture(b []byte) *tag.Picture {
+	field := func() []byte {
+		if len(b) < 4 {
+			return nil
+		}
+		size := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		if uint64(size) > uint64(len(b)) {
+			b = nil
+			return nil
+		}
+		value := b[:size]
+		b = b[size:]
+		return value
+	}
+	if len(b) < 4 {
+		return nil
+	}
+	pictureType := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	mimeType := field()
+	description := field()
+	// width, height, color depth, number of colors
+	if len(b) < 16 {
+		return nil
+	}
+	b = b[16:]
+	data := field()
+	if len(data) == 0 || len(data) > maxArtSize {
+		return nil
+	}
+
+	pic := &tag.Picture{
+		MIMEType:    string(mimeType),
+		Type:        "Other",
+		Description: string(description),
+		Data:        data,
+	}
+	if pictureType == 3 {
+		pic.Type = "Cover (front)"
+	}
+	switch pic.MIMEType {
+	case "image/jpeg":
+		pic.Ext = "jpg"
+	case "image/png":
+		pic.Ext = "png"
+	case "image/gif":
+		pic.Ext = "gif"
+	}
+	return pic
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// readID3v24TextFrames returns the values of the given text frames of
+// an ID3v2.4 tag. ID3v2.4 separates multiple values with null
+// characters, which the tag library drops when decoding text frames.
+// Tags using unsynchronisation, and compressed or encrypted frames,
+// are skipped.
+func readID3v24TextFrames(file string, ids ...string) map[string][]string {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer fd.Close()
+
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(fd, header); err != nil {
+		return nil
+	}
+	if string(header[:3]) != "ID3" || header[3] != 4 {
+		return nil
+	}
+	flags := header[5]
+	if flags&0x80 != 0 {
+		return nil
+	}
+	data := make([]byte, syncsafe(header[6:10]))
+	if _, err := io.ReadFull(fd, data); err != nil {
+		return nil
+	}
+	if flags&0x40 != 0 {
+		// the extended header size includes itself
+		if len(data) < 4 {
+			return nil
+		}
+		size := syncsafe(data[:4])
+		if size > len(data) {
+			return nil
+		}
+		data = data[size:]
+	}
+
+	frames := make(map[string][]string)
+	for len(data) >= 10 {
+		id := string(data[:4])
+		if id[0] == 0 {
+			// padding
+			break
+		}
+		size := syncsafe(data[4:8])
+		formatFlags := data[9]
+		data = data[10:]
+		if size > len(data) {
+			break
+		}
+		body := data[:size]
+		data = data[size:]
+
+		// compression, encryption, unsynchronisation, data length
+		if formatFlags&0x0f != 0 || !strings.HasPrefix(id, "T") {
+			continue
+		}
+		for _, want := range ids {
+			if id == want && len(body) > 0 {
+				frames[id] = decodeID3Text(body[0], body[1:])
+			}
+		}
+	}
+	return frames
+}
+
+// decodeID3Text decodes the null separated values of a text frame
+func decodeID3Text(encoding byte, b []byte) []string {
+	var values []string
+	switch encoding {
+	case 0: // ISO-8859-1
+		for _, part := range bytes.Split(b, []byte{0}) {
+			runes := make([]rune, len(part))
+			for i, c := range part {
+				runes[i] = rune(c)
+			}
+			values = append(values, string(runes))
+		}
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		var order binary.ByteOrder = binary.BigEndian
+		var units []uint16
+		for i := 0; i+1 < len(b); i += 2 {
+			unit := order.Uint16(b[i:])
+			switch {
+			case encoding == 1 && unit == 0xfffe:
+				order = binary.LittleEndian
+				continue
+			case encoding == 1 && unit == 0xfeff:
+				continue
+			case unit == 0:
+				values = append(values, string(utf16.Decode(units)))
+				units = units[:0]
+				// every value carries its own BOM
+				order = binary.BigEndian
+				continue
+			}
+			units = append(units, unit)
+		}
+		values = append(values, string(utf16.Decode(units)))
+	case 3: // UTF-8
+		values = strings.Split(string(b), "\x00")
+	default:
+		return nil
+	}
+
+	result := values[:0]
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0])<<21 | int(b[1])<<14 | int(b[2])<<7 | int(b[3])
+}
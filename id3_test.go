@@ -0,0 +1,52 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDecodeID3Text(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding byte
+		data     string
+		want     []string
+	}{
+		{"latin-1", 0, "caf\xe9", []string{"café"}},
+		{"latin-1 values", 0, "A\x00B\x00", []string{"A", "B"}},
+		{"utf-16 little endian", 1, "\xff\xfeA\x00\xe9\x00", []string{"Aé"}},
+		{"utf-16 big endian bom", 1, "\xfe\xff\x00A\x00\xe9", []string{"Aé"}},
+		{"utf-16 values with their own bom", 1, "\xff\xfeA\x00\x00\x00\xfe\xff\x00B", []string{"A", "B"}},
+		{"utf-16 surrogates", 1, "\xff\xfe\x3d\xd8\xb5\xdc", []string{"\U0001f4b5"}},
+		{"utf-16be", 2, "\x00A\x00\x00\x00B", []string{"A", "B"}},
+		{"utf-8 values", 3, "Ünö\x00 Two \x00", []string{"Ünö", "Two"}},
+		{"empty", 3, "", nil},
+		{"unknown encoding", 4, "A", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeID3Text(tt.encoding, []byte(tt.data))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncsafe(t *testing.T) {
+	tests := []struct {
+		b    []byte
+		want int
+	}{
+		{[]byte{0, 0, 0, 0}, 0},
+		{[]byte{0, 0, 0, 0x7f}, 127},
+		{[]byte{0, 0, 1, 0}, 128},
+		{[]byte{0, 0, 0x02, 0x01}, 257},
+		{[]byte{0x7f, 0x7f, 0x7f, 0x7f}, 1<<28 - 1},
+	}
+	for _, tt := range tests {
+		if got := syncsafe(tt.b); got != tt.want {
+			t.Errorf("syncsafe(%x) = %d, want %d", tt.b, got, tt.want)
+		}
+	}
+}
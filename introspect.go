@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+// argNames are the argument names of the MPRIS specification, which
+// the Go signatures don't carry. Out arguments follow the in ones.
+var argNames = map[string][]string{
+	"Seek":              {"Offset"},
+	"SetPosition":       {"TrackId", "Position"},
+	"OpenUri":           {"Uri"},
+	"GetTracksMetadata": {"TrackIds", "Metadata"},
+	"AddTrack":          {"Uri", "AfterTrack", "SetAsCurrent"},
+	"RemoveTrack":       {"TrackId"},
+	"GoTo":              {"TrackId"},
+	"ActivatePlaylist":  {"PlaylistId"},
+	"GetPlaylists":      {"Index", "MaxCount", "Order", "ReverseOrder", "Playlists"},
+}
+
+// signals are the signals the bridge emits on every interface
+var signals = map[string][]introspect.Signal{
+	"org.mpris.MediaPlayer2.Player": {
+		{Name: "Seeked", Args: []introspect.Arg{{Name: "Position", Type: "x"}}},
+	},
+	"org.mpris.MediaPlayer2.TrackList": {
+		{Name: "TrackListReplaced", Args: []introspect.Arg{{Name: "Tracks", Type: "ao"}, {Name: "CurrentTrack", Type: "o"}}},
+		{Name: "TrackAdded", Args: []introspect.Arg{{Name: "Metadata", Type: "a{sv}"}, {Name: "AfterTrack", Type: "o"}}},
+		{Name: "TrackRemoved", Args: []introspect.Arg{{Name: "TrackId", Type: "o"}}},
+		{Name: "TrackMetadataChanged", Args: []introspect.Arg{{Name: "TrackId", Type: "o"}, {Name: "Metadata", Type: "a{sv}"}}},
+	},
+}
+
+// exportIntrospection exports org.freedesktop.DBus.Introspectable on
+// path. The methods are read from the exported objects and the
+// properties from properties, so the data matches what is served.
+// ifaces lists the interface names in order, objects maps them to the
+// exported objects.
+func exportIntrospection(conn *dbus.Conn, path dbus.ObjectPath, properties *Properties, ifaces []string, objects map[string]any) error {
+	node := &introspect.Node{
+		Name:       string(path),
+		Interfaces: []introspect.Interface{prop.IntrospectData},
+	}
+	for _, name := range ifaces {
+		methods := introspect.Methods(objects[name])
+		for i := range methods {
+			names := argNames[methods[i].Name]
+			if len(names) != len(methods[i].Args) {
+				continue
+			}
+			for j := range methods[i].Args {
+				methods[i].Args[j].Name = names[j]
+			}
+		}
+		node.Interfaces = append(node.Interfaces, introspect.Interface{
+			Name:       name,
+			Methods:    methods,
+			Signals:    signals[name],
+			Properties: properties.Introspection(name),
+		})
+	}
+	return conn.Export(introspect.NewIntrospectable(node), path, "org.freedesktop.DBus.Introspectable")
+}
@@ -1,18 +1,30 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
 )
 
-func MPRISLoop(name string) error {
+var errLostBus = errors.New("lost the D-Bus connection")
+
+// how long the loop keeps serving after Quit, for its reply to be sent
+const quitDelay = 100 * time.Millisecond
+
+// MPRISLoop serves MOC on the bus as org.mpris.MediaPlayer2.<name>
+// until it's interrupted or asked to quit. The configuration is read
+// again from configPath on SIGHUP.
+func MPRISLoop(name string, configPath string, cfg *Config) error {
 	conn, err := dbus.ConnectSessionBus()
 	if err != nil {
 		return err
@@ -20,33 +32,67 @@ func MPRISLoop(name string) error {
 	defer conn.Close()
 	log.Println("DBus connection created")
 
-	mp, err := NewMocP()
+	// stops the external commands still running when the loop returns
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mp, err := NewMocP(ctx, cfg)
 	if err != nil {
 		return err
 	}
+	defer mp.Close()
 	log.Println("MocP instance initialized")
 
-	mp2, err := NewMediaPlayer2(conn, mp)
+	mp2p, err := NewMediaPlayer2Player(conn, mp)
+	if err != nil {
+		return err
+	}
+	log.Println("MediaPlayer2.Player instance created")
+
+	mp2, err := NewMediaPlayer2(conn, mp, mp2p, cfg)
 	if err != nil {
 		return err
 	}
 	log.Println("MediaPlayer2 instance created")
 
-	mp2p, err := NewMediaPlayer2Player(conn, mp)
+	mp2t, err := NewMediaPlayer2TrackList(conn, mp, mp2p)
 	if err != nil {
 		return err
 	}
-	log.Println("MediaPlayer2.Player instance created")
+	log.Println("MediaPlayer2.TrackList instance created")
 
-	// Register name
-	reply, err := conn.RequestName(fmt.Sprintf("org.mpris.MediaPlayer2.%s", name), dbus.NameFlagReplaceExisting)
+	mp2pl, err := NewMediaPlayer2Playlists(conn, mp, mp2p, cfg)
 	if err != nil {
 		return err
 	}
-	if reply != dbus.RequestNameReplyPrimaryOwner {
-		return errors.New("Name is already taken")
+	log.Println("MediaPlayer2.Playlists instance created")
+
+	bridge, err := NewBridge()
+	if err != nil {
+		return err
 	}
-	log.Printf("%s name successfully registered\n", name)
+	log.Println("Bridge instance created")
+
+	// all the interfaces share one org.freedesktop.DBus.Properties
+	// handler: exporting them separately would replace each other
+	properties, err := exportProperties(conn, "/org/mpris/MediaPlayer2", prop.Map{
+		"org.mpris.MediaPlayer2":           mp2.props(),
+		"org.mpris.MediaPlayer2.Player":    mp2p.props(),
+		"org.mpris.MediaPlayer2.TrackList": mp2t.props(),
+		"org.mpris.MediaPlayer2.Playlists": mp2pl.props(),
+		"org.moc_mpris_bridge.Bridge":      bridge.props(),
+	}, map[string]map[string]func() any{
+		"org.mpris.MediaPlayer2.Player": mp2p.getters(),
+	})
+	if err != nil {
+		return err
+	}
+	mp2.properties = properties
+	mp2p.properties = properties
+	mp2t.properties = properties
+	mp2pl.properties = properties
+	bridge.properties = properties
+	log.Println("MediaPlayer2 properties exported")
 
 	err = conn.Export(mp2, "/org/mpris/MediaPlayer2", "org.mpris.MediaPlayer2")
 	if err != nil {
@@ -60,28 +106,303 @@ func MPRISLoop(name string) error {
 	}
 	log.Println("MediaPlayer2.Player interface exported")
 
+	err = conn.Export(mp2t, "/org/mpris/MediaPlayer2", "org.mpris.MediaPlayer2.TrackList")
+	if err != nil {
+		return err
+	}
+	log.Println("MediaPlayer2.TrackList interface exported")
+
+	err = conn.Export(mp2pl, "/org/mpris/MediaPlayer2", "org.mpris.MediaPlayer2.Playlists")
+	if err != nil {
+		return err
+	}
+	log.Println("MediaPlayer2.Playlists interface exported")
+
+	err = conn.Export(bridge, "/org/mpris/MediaPlayer2", "org.moc_mpris_bridge.Bridge")
+	if err != nil {
+		return err
+	}
+	log.Println("Bridge interface exported")
+
+	err = exportIntrospection(conn, "/org/mpris/MediaPlayer2", properties, []string{
+		"org.mpris.MediaPlayer2",
+		"org.mpris.MediaPlayer2.Player",
+		"org.mpris.MediaPlayer2.TrackList",
+		"org.mpris.MediaPlayer2.Playlists",
+		"org.moc_mpris_bridge.Bridge",
+	}, map[string]any{
+		"org.mpris.MediaPlayer2":           mp2,
+		"org.mpris.MediaPlayer2.Player":    mp2p,
+		"org.mpris.MediaPlayer2.TrackList": mp2t,
+		"org.mpris.MediaPlayer2.Playlists": mp2pl,
+		"org.moc_mpris_bridge.Bridge":      bridge,
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("Introspection data exported")
+
+	// Register name, once clients can find everything behind it
+	busName := fmt.Sprintf("org.mpris.MediaPlayer2.%s", name)
+	reply, err := conn.RequestName(busName, dbus.NameFlagReplaceExisting)
+	if err != nil {
+		return err
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return errors.New("Name is already taken")
+	}
+	defer conn.ReleaseName(busName)
+	log.Printf("%s name successfully registered\n", name)
+
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGINT)
+	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	log.Println("Starting loop...")
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("couldn't notify systemd: %v", err)
+	}
+	defer sdNotify("STOPPING=1")
 
-	ticker := time.NewTicker(time.Second)
+	// the watchdog is pinged from the loop, so that a stuck loop gets
+	// the bridge restarted
+	var watchdog <-chan time.Time
+	if interval := watchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+	var status string
+	notifyStatus := func() {
+		if line := statusLine(mp, bridge); line != status {
+			status = line
+			sdNotify("STATUS=" + line)
+		}
+	}
+
+	update := func() error {
+		if err := mp2.update(); err != nil {
+			return err
+		}
+		if err := mp2t.refresh(); err != nil {
+			return err
+		}
+		if err := mp2p.update(); err != nil {
+			return err
+		}
+		if err := mp2t.update(); err != nil {
+			return err
+		}
+		return mp2pl.update()
+	}
+
+	// failing updates are retried with backoff; until then, only the
+	// commands of clients try again. Only losing the bus is fatal.
+	var retryAt time.Time
+	retry := time.NewTimer(maxBackoff)
+	retry.Stop()
+	refresh := func(force bool) error {
+		if !conn.Connected() {
+			return errLostBus
+		}
+		if !force && time.Now().Before(retryAt) {
+			return nil
+		}
+		err := update()
+		if err == nil {
+			retryAt = time.Time{}
+			err = bridge.succeeded()
+		} else {
+			if lostBus(conn, err) {
+				return errLostBus
+			}
+			var delay time.Duration
+			delay, err = bridge.failed(err)
+			retryAt = time.Now().Add(delay)
+			retry.Reset(delay)
+		}
+		notifyStatus()
+		if err != nil {
+			// the health of the bridge couldn't be published
+			if lostBus(conn, err) {
+				return errLostBus
+			}
+			limitedLog.Printf("couldn't publish the bridge status: %v", err)
+		}
+		return nil
+	}
+
+	watcher, events := watchMoc()
+	// the watchers may be replaced
+	defer func() { watcher.Close() }()
+	sockets, socketChanges := watchMocSocket()
+	defer func() { sockets.Close() }()
+	poll := newPoller(cfg)
+	pollTimer := time.NewTimer(0)
+	var quitting <-chan time.Time
+	// schedule sets the next poll from the state refreshed last
+	schedule := func() {
+		timeLeft, hasEnd := mp.TimeLeft()
+		playing := mp.GetPlaybackStatus() == "Playing"
+		pollTimer.Reset(poll.next(playing, timeLeft, hasEnd, events != nil))
+	}
 	for {
 		select {
 		case dbusMethod := <-mp2p.commands:
 			// Dbus methods asked to do something
 			dbusMethod.result <- dbusMethod.action()
-			if err := mp2p.update(); err != nil {
+			if !dbusMethod.changes {
+				continue
+			}
+			poll.burst()
+			if err := refresh(true); err != nil {
+				return err
+			}
+			schedule()
+		case res := <-mp.ArtResults():
+			// cover art looked up in the background
+			mp.SetArt(res)
+			if err := refresh(false); err != nil {
+				return err
+			}
+		case ev, ok := <-events:
+			if isPlaylistEvent(ev) {
+				mp2t.invalidate()
+			}
+			if !ok {
+				log.Println("Lost MOC server events, polling...")
+				watcher.Close()
+				watcher, events = nil, nil
+			}
+			poll.wake()
+			if err := refresh(false); err != nil {
+				return err
+			}
+			schedule()
+		case _, ok := <-socketChanges:
+			// the server came up or went away
+			if !ok {
+				log.Println("Lost the MOC directory, polling...")
+				sockets.Close()
+				sockets, socketChanges = nil, nil
+			}
+			if events == nil {
+				watcher, events = watchMoc()
+			}
+			poll.wake()
+			mp2t.invalidate()
+			if err := refresh(true); err != nil {
+				return err
+			}
+			schedule()
+		case <-pollTimer.C:
+			// safety poll, or regular poll without server events
+			if events == nil {
+				watcher, events = watchMoc()
+			}
+			if socketChanges == nil {
+				sockets, socketChanges = watchMocSocket()
+			}
+			// the server announces playlist changes, and the commands
+			// changing the playlist invalidate it themselves
+			if events == nil && !poll.bursting() {
+				mp2t.invalidate()
+			}
+			if err := refresh(false); err != nil {
 				return err
 			}
-		case <-ticker.C:
-			// poll every second
-			if err := mp2p.update(); err != nil {
+			schedule()
+		case <-retry.C:
+			if err := refresh(true); err != nil {
 				return err
 			}
-		case <-c:
-			log.Println("Interruption...")
+			schedule()
+		case <-conn.Context().Done():
+			return errLostBus
+		case <-mp2.quit:
+			log.Println("Quitting...")
+			// keep serving until the reply is sent
+			quitting = time.After(quitDelay)
+		case <-quitting:
 			return nil
+		case <-watchdog:
+			sdNotify("WATCHDOG=1")
+		case sig := <-c:
+			if sig != syscall.SIGHUP {
+				log.Printf("Received %v, shutting down...", sig)
+				return nil
+			}
+			sdNotify("RELOADING=1")
+			newCfg, err := LoadConfig(configPath)
+			if err != nil {
+				log.Printf("couldn't reload the configuration: %v", err)
+			} else {
+				log.Printf("Configuration reloaded from %s", configPath)
+				mp.configure(newCfg)
+				mp2.configure(newCfg)
+				mp2pl.configure(newCfg)
+				poll.configure(newCfg)
+			}
+			sdNotify("READY=1")
+			if err := refresh(true); err != nil {
+				return err
+			}
+			schedule()
 		}
 	}
 }
+
+// lostBus tells whether err came from losing the bus, the only error
+// the loop doesn't recover from
+func lostBus(conn *dbus.Conn, err error) bool {
+	return !conn.Connected() || errors.Is(err, dbus.ErrClosed)
+}
+
+// watchMoc subscribes to the events of the MOC server. The channel is
+// nil when the server can't be reached.
+func watchMoc() (*MocClient, <-chan int) {
+	watcher, err := NewMocClient(MocSocketPath())
+	if err != nil {
+		return nil, nil
+	}
+	events, err := watcher.Watch()
+	if err != nil {
+		watcher.Close()
+		return nil, nil
+	}
+	log.Println("Subscribed to MOC server events")
+	return watcher, events
+}
+
+// watchMocSocket watches the MOC socket being created and removed. The
+// channel is nil when the MOC directory can't be watched.
+func watchMocSocket() (*socketWatch, <-chan struct{}) {
+	sockets, changes, err := watchSocket(MocSocketPath())
+	if err != nil {
+		return nil, nil
+	}
+	log.Println("Watching the MOC socket")
+	return sockets, changes
+}
+
+// statusLine describes what the bridge is doing, for systemctl status
+func statusLine(mp *MocP, bridge *Bridge) string {
+	if bridge.failures > 0 {
+		return bridge.Status()
+	}
+	if server := mp.Server(); server != serverConnected {
+		return fmt.Sprintf("MOC server %s", server)
+	}
+	state := mp.GetPlaybackStatus()
+	metadata := mp.GetMetadata()
+	title, _ := metadata["xesam:title"].(string)
+	if url, ok := metadata["xesam:url"].(string); ok && title == "" {
+		title = filepath.Base(url)
+	}
+	if state == "Stopped" || title == "" {
+		return state
+	}
+	if artists, _ := metadata["xesam:artist"].([]string); len(artists) > 0 {
+		title = strings.Join(artists, ", ") + " - " + title
+	}
+	return state + ": " + title
+}
@@ -21,14 +21,19 @@ func main() {
 		fmt.Fprintf(os.Stderr, "        Print current version\n")
 		fmt.Fprintf(os.Stderr, "  -n, -name NAME\n")
 		fmt.Fprintf(os.Stderr, "        Register interface with NAME. Default: moc-mpris-bridge\n")
+		fmt.Fprintf(os.Stderr, "  -c, -config FILE\n")
+		fmt.Fprintf(os.Stderr, "        Read settings from FILE. Default: %s\n", DefaultConfigPath())
 	}
 
 	var version bool
 	var name string
+	var configPath string
 	flag.BoolVar(&version, "v", false, "print current version")
 	flag.BoolVar(&version, "version", false, "print current version")
 	flag.StringVar(&name, "n", "moc-mpris-bridge", "register service with this name")
 	flag.StringVar(&name, "name", "moc-mpris-bridge", "register service with this name")
+	flag.StringVar(&configPath, "c", DefaultConfigPath(), "read settings from this file")
+	flag.StringVar(&configPath, "config", DefaultConfigPath(), "read settings from this file")
 	flag.Parse()
 
 	if len(flag.Args()) > 0 {
@@ -40,7 +45,11 @@ func main() {
 		fmt.Printf("%s version %s\n", os.Args[0], VERSION)
 		return
 	}
-	err := MPRISLoop(name)
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = MPRISLoop(name, configPath, cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -1,49 +1,149 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
-	"os"
+	"os/exec"
+	"syscall"
+	"time"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/godbus/dbus/v5/prop"
 )
 
+// the focus hook is given this long to find the window of mocp
+const focusHookTimeout = 2 * time.Second
+
 type MediaPlayer2 struct {
-	mp         *MocP
-	conn       *dbus.Conn
-	properties *prop.Properties
+	mp           *MocP
+	conn         *dbus.Conn
+	properties   *Properties
+	player       *MediaPlayer2Player
+	propValues   map[string]any
+	quit         chan struct{}
+	allowQuit    bool
+	raiseCommand string
+	focusCommand string
+	desktopEntry string
 }
 
-func NewMediaPlayer2(conn *dbus.Conn, mp *MocP) (*MediaPlayer2, error) {
+func NewMediaPlayer2(conn *dbus.Conn, mp *MocP, player *MediaPlayer2Player, cfg *Config) (*MediaPlayer2, error) {
 	mp2 := &MediaPlayer2{}
 	mp2.mp = mp
 	mp2.conn = conn
-	props := map[string]*prop.Prop{
-		"CanQuit":          newProp(true, nil),
-		"Fullscreen":       newProp(false, nil),
-		"CanSetFullscreen": newProp(false, nil),
-		"CanRaise":         newProp(false, nil),
-		"HasTrackList":     newProp(false, nil),
-		"Identity":         newProp("Media On Console", nil),
-	}
-
-	var err error
-	mp2.properties, err = prop.Export(mp2.conn, "/org/mpris/MediaPlayer2", map[string]map[string]*prop.Prop{
-		"org.mpris.MediaPlayer2": props,
+	mp2.player = player
+	mp2.quit = make(chan struct{}, 1)
+	mp2.configure(cfg)
+
+	return mp2, nil
+}
+
+// configure takes the settings of the root interface from cfg. The
+// next update announces the properties that changed.
+func (m *MediaPlayer2) configure(cfg *Config) {
+	m.allowQuit = cfg.AllowQuit
+	m.raiseCommand = cfg.RaiseCommand
+	m.focusCommand = cfg.FocusCommand
+	m.desktopEntry = cfg.DesktopEntry
+}
+
+// props returns the properties of org.mpris.MediaPlayer2, and records
+// their values as published
+func (m *MediaPlayer2) props() map[string]*prop.Prop {
+	m.propValues = m.values()
+	props := make(map[string]*prop.Prop)
+	for name, value := range m.propValues {
+		props[name] = newProp(value, nil)
+	}
+	// clients may only set it when CanSetFullscreen is true
+	props["Fullscreen"] = newProp(false, m.setFullscreen)
+	return props
+}
+
+// values returns the current values of the properties
+func (m *MediaPlayer2) values() map[string]any {
+	return map[string]any{
+		"CanQuit":             m.allowQuit,
+		"Fullscreen":          false,
+		"CanSetFullscreen":    false,
+		"CanRaise":            m.raiseCommand != "",
+		"HasTrackList":        true,
+		"Identity":            "Media On Console",
+		"DesktopEntry":        m.desktopEntry,
+		"SupportedUriSchemes": supportedUriSchemes,
+		"SupportedMimeTypes":  supportedMimeTypes,
+	}
+}
+
+// update announces the properties whose value changed
+func (m *MediaPlayer2) update() error {
+	changed, err := m.properties.publishChanged("org.mpris.MediaPlayer2", m.propValues, m.values())
+	for _, key := range changed {
+		log.Printf("MediaPlayer2.%s was updated\n", key)
+	}
+	return err
+}
+
+func (m *MediaPlayer2) setFullscreen(*prop.Change) *dbus.Error {
+	return dbus.MakeFailedError(errors.New("fullscreen is not supported"))
+}
+
+// Raise focuses the window of mocp through the focus hook, if there is
+// one and it succeeds, and otherwise opens mocp with the raise command
+func (m *MediaPlayer2) Raise() *dbus.Error {
+	// the commands can change when the configuration is reloaded
+	var raiseCommand, focusCommand string
+	err := m.player.query(func() error {
+		log.Println("MediaPlayer2.Raise was called")
+		raiseCommand, focusCommand = m.raiseCommand, m.focusCommand
+		return nil
 	})
 	if err != nil {
-		return nil, err
+		return makeError(err)
 	}
-	log.Println("MediaPlayer2 properties exported")
-
-	return mp2, nil
+	if raiseCommand == "" {
+		return nil
+	}
+	if focusCommand != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), focusHookTimeout)
+		defer cancel()
+		if err := shellCommand(ctx, focusCommand).Run(); err == nil {
+			return nil
+		}
+	}
+	cmd := shellCommand(context.Background(), raiseCommand)
+	if err := cmd.Start(); err != nil {
+		return makeError(err)
+	}
+	// the terminal outlives the call
+	go cmd.Wait()
+	return nil
 }
 
-func (m *MediaPlayer2) Raise() {
+// Quit stops the MOC server, then tells the loop to exit
+func (m *MediaPlayer2) Quit() *dbus.Error {
+	err := m.player.do(func() error {
+		log.Println("MediaPlayer2.Quit was called")
+		if !m.allowQuit {
+			return errors.New("quitting is disabled")
+		}
+		return m.mp.Exit()
+	})
+	if err != nil {
+		return makeError(err)
+	}
+	select {
+	case m.quit <- struct{}{}:
+	default:
+	}
+	return nil
 }
 
-func (m *MediaPlayer2) Quit() {
-	m.mp.Exit()
-	m.conn.Close()
-	os.Exit(0)
+// shellCommand runs a command from the config through the shell, in a
+// session of its own so that it isn't tied to the bridge's terminal
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	return cmd
 }
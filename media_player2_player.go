@@ -2,25 +2,38 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log"
-	"reflect"
+	"time"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/godbus/dbus/v5/prop"
 )
 
 type MediaPlayer2Player struct {
-	mp            *MocP
-	conn          *dbus.Conn
-	propValues    map[string]any
-	properties    *prop.Properties
-	commands      chan command
-	seekedEmitted bool
+	mp         *MocP
+	conn       *dbus.Conn
+	propValues map[string]any
+	properties *Properties
+	commands   chan command
+
+	// position extrapolated between updates, for the track clockTrack;
+	// reports of MOC are ignored until seekDeadline after our own seeks
+	clock        positionClock
+	clockTrack   dbus.ObjectPath
+	seekDeadline time.Time
 }
 
+// MOC is given this long to carry out a seek before its position is
+// trusted again
+const seekGrace = 2 * time.Second
+
 type command struct {
 	action func() error
 	result chan error
+	// whether the action may change the state of MOC, which is
+	// refreshed after it
+	changes bool
 }
 
 func NewMediaPlayer2Player(conn *dbus.Conn, mp *MocP) (*MediaPlayer2Player, error) {
@@ -29,17 +42,13 @@ func NewMediaPlayer2Player(conn *dbus.Conn, mp *MocP) (*MediaPlayer2Player, erro
 	mp2p.conn = conn
 	mp2p.commands = make(chan command)
 
-	var err error
-	mp2p.propValues, mp2p.properties, err = mp2p.exportProps()
-	if err != nil {
-		return nil, err
-	}
-	log.Println("MediaPlayer2.Player properties exported")
-
 	return mp2p, nil
 }
 
-func (mp2p *MediaPlayer2Player) exportProps() (map[string]any, *prop.Properties, error) {
+// props returns the properties of org.mpris.MediaPlayer2.Player, with
+// the setters of the writable ones, and records their values as
+// published
+func (mp2p *MediaPlayer2Player) props() map[string]*prop.Prop {
 	propValues := make(map[string]any)
 	propertiesMap := make(map[string]*prop.Prop)
 
@@ -63,52 +72,97 @@ func (mp2p *MediaPlayer2Player) exportProps() (map[string]any, *prop.Properties,
 	setProp("CanSeek", mp2p.getCanSeek(), nil)
 	setProp("CanControl", true, nil)
 
-	// The org.freedesktop.DBus.Properties.PropertiesChanged signal is not emitted when this property (Position) changes. We need to set EmitFalse in the prop creation
+	// The org.freedesktop.DBus.Properties.PropertiesChanged signal is not emitted when this property (Position) changes. We need to set EmitFalse in the prop creation.
+	// Clients reading it get the extrapolated position, see getters.
 	posName := "Position"
 	posValue := mp2p.getPosition()
 	propValues[posName] = posValue
 	propertiesMap[posName] = &prop.Prop{
 		Value:    posValue,
-		Writable: true,
+		Writable: false,
 		Emit:     prop.EmitFalse,
 		Callback: nil,
 	}
 
-	properties, err := prop.Export(mp2p.conn, "/org/mpris/MediaPlayer2", map[string]map[string]*prop.Prop{
-		"org.mpris.MediaPlayer2.Player": propertiesMap,
-	})
+	mp2p.propValues = propValues
+	return propertiesMap
+}
 
-	return propValues, properties, err
+// getters returns the properties computed when clients read them
+func (mp2p *MediaPlayer2Player) getters() map[string]func() any {
+	return map[string]func() any{
+		"Position": func() any { return mp2p.getPosition() },
+	}
 }
 
-func (mp2p *MediaPlayer2Player) update() *dbus.Error {
+func (mp2p *MediaPlayer2Player) update() error {
 	err := mp2p.mp.UpdateInfo()
 	if err != nil {
-		return dbus.MakeFailedError(err)
+		return err
 	}
 	err = mp2p.triggerSeeked()
 	if err != nil {
-		return dbus.MakeFailedError(err)
-	}
-	for key, value := range mp2p.propValues {
-		newVal := mp2p.getCurrVal(key)
-		if !reflect.DeepEqual(newVal, value) {
-			mp2p.propValues[key] = newVal
-			err := mp2p.properties.Set("org.mpris.MediaPlayer2.Player", key, dbus.MakeVariant(newVal))
-			if err != nil {
-				return err
-			}
-			log.Printf("MediaPlayer2.Player.%s was updated\n", key)
-		}
+		return err
 	}
-	return nil
+	values := make(map[string]any, len(mp2p.propValues))
+	for key := range mp2p.propValues {
+		values[key] = mp2p.getCurrVal(key)
+	}
+	changed, err := mp2p.properties.publishChanged("org.mpris.MediaPlayer2.Player", mp2p.propValues, values)
+	for _, key := range changed {
+		log.Printf("MediaPlayer2.Player.%s was updated\n", key)
+	}
+	return err
 }
 
+// D-Bus calls give up waiting for the loop after this long, which
+// leaves room for one stuck external command
+const callTimeout = 2 * commandTimeout
+
+var errTimeout = errors.New("timed out")
+
+// do runs action in the loop and returns its error. If the loop doesn't
+// take the action within callTimeout it is dropped; if the action
+// doesn't finish in time, it goes on but the caller gets errTimeout.
 func (mp2p *MediaPlayer2Player) do(action func() error) error {
-	result := make(chan error, 1)
-	mp2p.commands <- command{action: action, result: result}
+	return mp2p.send(command{action: action, changes: true})
+}
 
-	return <-result
+// query runs action in the loop like do, for calls that only read the
+// state of the bridge
+func (mp2p *MediaPlayer2Player) query(action func() error) error {
+	return mp2p.send(command{action: action})
+}
+
+func (mp2p *MediaPlayer2Player) send(cmd command) error {
+	cmd.result = make(chan error, 1)
+	timer := time.NewTimer(callTimeout)
+	defer timer.Stop()
+
+	select {
+	case mp2p.commands <- cmd:
+	case <-timer.C:
+		stuckCommands.Add(1)
+		limitedLog.Printf("the loop is busy, a D-Bus call was dropped")
+		return fmt.Errorf("the bridge is busy: %w", errTimeout)
+	}
+	select {
+	case err := <-cmd.result:
+		return err
+	case <-timer.C:
+		stuckCommands.Add(1)
+		limitedLog.Printf("a D-Bus call didn't finish in time")
+		return fmt.Errorf("the command %w", errTimeout)
+	}
+}
+
+// makeError turns the error of a command into a D-Bus error; commands
+// that timed out get the standard Timeout error
+func makeError(err error) *dbus.Error {
+	if errors.Is(err, errTimeout) {
+		return dbus.NewError("org.freedesktop.DBus.Error.Timeout", []any{err.Error()})
+	}
+	return dbus.MakeFailedError(err)
 }
 
 func (mp2p *MediaPlayer2Player) getInfo(key string) any {
@@ -173,7 +227,7 @@ func (mp2p *MediaPlayer2Player) Next() *dbus.Error {
 	})
 
 	if err != nil {
-		return dbus.MakeFailedError(err)
+		return makeError(err)
 	}
 	return nil
 }
@@ -193,7 +247,7 @@ func (mp2p *MediaPlayer2Player) Previous() *dbus.Error {
 	})
 
 	if err != nil {
-		return dbus.MakeFailedError(err)
+		return makeError(err)
 	}
 	return nil
 }
@@ -212,7 +266,7 @@ func (mp2p *MediaPlayer2Player) Pause() *dbus.Error {
 		return nil
 	})
 	if err != nil {
-		return dbus.MakeFailedError(err)
+		return makeError(err)
 	}
 
 	return nil
@@ -220,7 +274,7 @@ func (mp2p *MediaPlayer2Player) Pause() *dbus.Error {
 
 func (mp2p *MediaPlayer2Player) PlayPause() *dbus.Error {
 	err := mp2p.do(func() error {
-		if !mp2p.getCanPlay() || !mp2p.getCanPause() {
+		if !mp2p.getCanPause() {
 			log.Println("MediaPlayer2.Player.PlayPause is not allowed")
 			return nil
 		}
@@ -232,7 +286,7 @@ func (mp2p *MediaPlayer2Player) PlayPause() *dbus.Error {
 		return nil
 	})
 	if err != nil {
-		return dbus.MakeFailedError(err)
+		return makeError(err)
 	}
 
 	return nil
@@ -248,7 +302,7 @@ func (mp2p *MediaPlayer2Player) Stop() *dbus.Error {
 		return nil
 	})
 	if err != nil {
-		return dbus.MakeFailedError(err)
+		return makeError(err)
 	}
 
 	return nil
@@ -261,19 +315,25 @@ func (mp2p *MediaPlayer2Player) Play() *dbus.Error {
 			return nil
 		}
 		log.Println("MediaPlayer2.Player.Play was called")
-		err := mp2p.mp.Unpause()
-		if err != nil {
-			return err
+		switch mp2p.getPlaybackStatus() {
+		case "Paused":
+			return mp2p.mp.Unpause()
+		case "Stopped":
+			return mp2p.mp.Play()
 		}
 		return nil
 	})
 	if err != nil {
-		return dbus.MakeFailedError(err)
+		return makeError(err)
 	}
 
 	return nil
 }
 
+// Seek moves the position by microseconds. As the spec asks, seeking
+// before the start goes to the start, and seeking past the end goes to
+// the next track. MOC only jumps to whole seconds: Seeked reports the
+// second it actually went to.
 func (mp2p *MediaPlayer2Player) Seek(microseconds int64) *dbus.Error {
 	err := mp2p.do(func() error {
 		if !mp2p.getCanSeek() {
@@ -281,26 +341,20 @@ func (mp2p *MediaPlayer2Player) Seek(microseconds int64) *dbus.Error {
 			return nil
 		}
 		log.Println("MediaPlayer2.Player.Seek was called")
-		seconds := int(microseconds) / 1000000
-		err := mp2p.mp.Seek(seconds)
-		if err != nil {
-			return err
+		target := max(mp2p.getPosition()+microseconds, 0)
+		if length := mp2p.getLength(); length > 0 && target >= length {
+			return mp2p.mp.Next()
 		}
-
-		current_seconds, ok := mp2p.getInfo(CurrentSec).(int)
-		if !ok {
-			return nil
-		}
-		current_microseconds := int64(current_seconds+seconds) * 1000000
-		err = mp2p.Seeked(current_microseconds)
+		seconds := toSeconds(target)
+		err := mp2p.mp.Jump(seconds)
 		if err != nil {
 			return err
 		}
-		return nil
+		return mp2p.seekedTo(seconds)
 	})
 
 	if err != nil {
-		return dbus.MakeFailedError(err)
+		return makeError(err)
 	}
 
 	return nil
@@ -312,22 +366,44 @@ func (mp2p *MediaPlayer2Player) SetPosition(trackId dbus.ObjectPath, microsecond
 			log.Println("MediaPlayer2.Player.SetPosition is not allowed")
 			return nil
 		}
+		// the spec asks to ignore calls for a track that isn't current,
+		// and positions outside of the track
+		if trackId != mp2p.mp.TrackID() {
+			log.Println("MediaPlayer2.Player.SetPosition was called for a stale track")
+			return nil
+		}
+		if microseconds < 0 || microseconds > mp2p.getLength() {
+			log.Println("MediaPlayer2.Player.SetPosition was called out of the track")
+			return nil
+		}
 		log.Println("MediaPlayer2.Player.SetPosition was called")
-		seconds := int(microseconds) / 1000000
+		seconds := toSeconds(microseconds)
 		err := mp2p.mp.Jump(seconds)
 		if err != nil {
 			return err
 		}
+		return mp2p.seekedTo(seconds)
+	})
+
+	if err != nil {
+		return makeError(err)
+	}
+
+	return nil
+}
 
-		err = mp2p.Seeked(microseconds)
+func (mp2p *MediaPlayer2Player) OpenUri(uri string) *dbus.Error {
+	err := mp2p.do(func() error {
+		log.Println("MediaPlayer2.Player.OpenUri was called")
+		files, err := resolveUri(uri)
 		if err != nil {
 			return err
 		}
-		return nil
+		return mp2p.mp.Open(files)
 	})
 
 	if err != nil {
-		return dbus.MakeFailedError(err)
+		return makeError(err)
 	}
 
 	return nil
@@ -337,64 +413,54 @@ func (mp2p *MediaPlayer2Player) SetPosition(trackId dbus.ObjectPath, microsecond
 
 func (mp2p *MediaPlayer2Player) Seeked(position int64) error {
 	log.Println("MediaPlayer2.Player.Seeked was signalled")
-	mp2p.seekedEmitted = true
 	err := mp2p.conn.Emit("/org/mpris/MediaPlayer2", "org.mpris.MediaPlayer2.Player.Seeked", position)
 
 	return err
 }
 
-// check if position changed by more than 2 second ahead between updates,
-// or if position is smaller than the old position.
-// This may mean that mocp was seeked outside of DBus
+// triggerSeeked anchors the position clock on the position reported
+// by MOC, and signals Seeked if it jumped: that is, it's further than
+// seekedTolerance from the extrapolated position. As long as MOC
+// reports the second the clock is in, the clock keeps running.
 func (mp2p *MediaPlayer2Player) triggerSeeked() error {
-	// first check if dbus triggered a seek or set position;
-	// in that case, reset the seekEmitted flag and ignore
-	if mp2p.seekedEmitted {
-		mp2p.seekedEmitted = false
-		return nil
-	}
-	oldPositionAny := mp2p.propValues["Position"]
-	oldPosition, ok := oldPositionAny.(int64)
-	if !ok {
+	reported := mp2p.getReportedPosition()
+	playing := mp2p.getPlaybackStatus() == "Playing"
+	length := mp2p.getLength()
+
+	// a new track, or the same file starting over
+	if trackID := mp2p.mp.TrackID(); trackID != mp2p.clockTrack {
+		mp2p.clockTrack = trackID
+		mp2p.seekDeadline = time.Time{}
+		mp2p.clock.Set(reported, playing, length)
 		return nil
 	}
 
-	// check the file is the same, i.e. we
-	// haven't done a Next() or Previous()
-	fileAny := mp2p.getInfo(File)
-	file, ok := fileAny.(string)
-	if !ok {
-		return nil
-	}
-
-	oldMetadataAny, ok := mp2p.propValues["Metadata"]
-	if !ok {
-		return nil
-	}
-	oldMetadata, ok := oldMetadataAny.(map[string]any)
-	if !ok {
+	expected := mp2p.clock.Position()
+	diff := time.Duration(reported-expected) * time.Microsecond
+	if diff.Abs() <= seekedTolerance {
+		mp2p.seekDeadline = time.Time{}
+		// keep the position within the second reported
+		mp2p.clock.Set(min(max(expected, reported), reported+999999), playing, length)
 		return nil
 	}
-	oldFile, ok := oldMetadata["xesam:url"].(string)
-	if !ok {
+	if time.Now().Before(mp2p.seekDeadline) {
+		// MOC hasn't carried out our seek yet
+		mp2p.clock.Set(expected, playing, length)
 		return nil
 	}
 
-	if file != oldFile {
-		return nil
-	}
+	mp2p.clock.Set(reported, playing, length)
+	log.Println("MediaPlayer2.Player.Seeked was signalled by external process")
+	return mp2p.Seeked(reported)
+}
 
-	position := mp2p.getPosition()
-	twoSeconds := int64(2000000)
-	if position-oldPosition >= twoSeconds || position < oldPosition {
-		log.Println("MediaPlayer2.Player.Seeked was signalled by external process")
-		err := mp2p.Seeked(position)
-		mp2p.seekedEmitted = false
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+// seekedTo anchors the clock at the position a seek of ours went to,
+// and signals it
+func (mp2p *MediaPlayer2Player) seekedTo(seconds int) error {
+	position := int64(seconds) * 1000000
+	mp2p.seekDeadline = time.Now().Add(seekGrace)
+	mp2p.clock.Set(position, mp2p.getPlaybackStatus() == "Playing", mp2p.getLength())
+	return mp2p.Seeked(position)
 }
 
 // Properties
@@ -404,28 +470,22 @@ func (mp2p *MediaPlayer2Player) getPlaybackStatus() string {
 }
 
 func (mp2p *MediaPlayer2Player) getLoopStatus() string {
-	// TODO: implement loop status fetch
 	return mp2p.mp.GetLoopStatus()
 }
 
+// The setters run in the loop like the methods. They don't publish the
+// new value themselves: the update following every command does.
 func (mp2p *MediaPlayer2Player) setLoopStatus(change *prop.Change) *dbus.Error {
 	value, ok := change.Value.(string)
 	if !ok {
 		return dbus.MakeFailedError(errors.New("wrong LoopStatus change"))
 	}
-	switch value {
-	case "None":
-		err := mp2p.mp.SetRepeat(false)
-		if err != nil {
-			return dbus.MakeFailedError(err)
-		}
-	case "Track", "Playlist":
-		err := mp2p.mp.SetRepeat(true)
-		if err != nil {
-			return dbus.MakeFailedError(err)
-		}
+	err := mp2p.do(func() error {
+		return mp2p.mp.SetLoopStatus(value)
+	})
+	if err != nil {
+		return makeError(err)
 	}
-
 	return nil
 }
 
@@ -434,15 +494,16 @@ func (mp2p *MediaPlayer2Player) setRate(change *prop.Change) *dbus.Error {
 	if !ok {
 		return dbus.MakeFailedError(errors.New("wrong Rate change"))
 	}
-	err := mp2p.mp.SetRate(value)
+	err := mp2p.do(func() error {
+		return mp2p.mp.SetRate(value)
+	})
 	if err != nil {
-		return dbus.MakeFailedError(err)
+		return makeError(err)
 	}
 	return nil
 }
 
 func (mp2p *MediaPlayer2Player) getShuffle() bool {
-	// TODO: implement loop status fetch
 	return mp2p.mp.GetShuffle()
 }
 
@@ -451,9 +512,11 @@ func (mp2p *MediaPlayer2Player) setShuffle(change *prop.Change) *dbus.Error {
 	if !ok {
 		return dbus.MakeFailedError(errors.New("wrong Shuffle change"))
 	}
-	err := mp2p.mp.SetShuffle(value)
+	err := mp2p.do(func() error {
+		return mp2p.mp.SetShuffle(value)
+	})
 	if err != nil {
-		return dbus.MakeFailedError(err)
+		return makeError(err)
 	}
 	return nil
 }
@@ -467,24 +530,41 @@ func (mp2p *MediaPlayer2Player) getVolume() float64 {
 }
 
 func (mp2p *MediaPlayer2Player) setVolume(change *prop.Change) *dbus.Error {
-	log.Println("MediaPlayer2.Player setVolume was called")
-	volume, ok := change.Value.(float64)
+	value, ok := change.Value.(float64)
 	if !ok {
 		return dbus.MakeFailedError(errors.New("wrong Volume change"))
 	}
-	newVol := int(100 * volume)
-	err := mp2p.mp.Volume(newVol)
-
+	err := mp2p.do(func() error {
+		log.Println("MediaPlayer2.Player setVolume was called")
+		return mp2p.mp.Volume(int(100 * value))
+	})
 	if err != nil {
-		return dbus.MakeFailedError(err)
+		return makeError(err)
 	}
 	return nil
 }
 
+// getPosition returns the extrapolated position in microseconds
 func (mp2p *MediaPlayer2Player) getPosition() int64 {
+	return mp2p.clock.Position()
+}
+
+// getReportedPosition returns the position reported by MOC, in whole
+// seconds
+func (mp2p *MediaPlayer2Player) getReportedPosition() int64 {
 	return int64(mp2p.mp.GetPosition()) * 1000000
 }
 
+// getLength returns the length of the current track in microseconds,
+// 0 if it's unknown
+func (mp2p *MediaPlayer2Player) getLength() int64 {
+	totalSec, ok := mp2p.getInfo(TotalSec).(int)
+	if !ok {
+		return 0
+	}
+	return int64(totalSec) * 1000000
+}
+
 func (mp2p *MediaPlayer2Player) getCanGoNext() bool {
 	return mp2p.mp.CanGoNext()
 }
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+// fakeMocp puts on PATH a mocp that always plays the same file, and an
+// amixer, and points MOCDIR to a directory without a server socket
+func fakeMocp(t *testing.T) {
+	t.Helper()
+	bin := t.TempDir()
+	scripts := map[string]string{
+		"mocp": `#!/bin/sh
+if [ "$1" = "-i" ]; then
+	printf 'State: PLAY\nFile: /music/a.mp3\nTitle: a\nTotalTime: 03:00\nTimeLeft: 02:50\nTotalSec: 180\nCurrentSec: 10\n'
+fi
+`,
+		"amixer": `#!/bin/sh
+echo 'Front Left: Playback 40 [50%] [on]'
+`,
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("MOCDIR", t.TempDir())
+}
+
+type testBridge struct {
+	mp2        *MediaPlayer2
+	mp2p       *MediaPlayer2Player
+	properties *Properties
+}
+
+// newTestBridge exports the root and player interfaces on a session
+// bus connection of its own, and runs a loop serving their commands
+// and updating them often until the test ends
+func newTestBridge(t *testing.T) *testBridge {
+	t.Helper()
+	fakeMocp(t)
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		t.Skipf("no session bus: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	cfg := DefaultConfig()
+	cfg.PlaylistDirs = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	mp, err := NewMocP(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp2p, err := NewMediaPlayer2Player(conn, mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp2, err := NewMediaPlayer2(conn, mp, mp2p, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	properties, err := exportProperties(conn, "/org/mpris/MediaPlayer2", prop.Map{
+		"org.mpris.MediaPlayer2":        mp2.props(),
+		"org.mpris.MediaPlayer2.Player": mp2p.props(),
+	}, map[string]map[string]func() any{
+		"org.mpris.MediaPlayer2.Player": mp2p.getters(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp2.properties = properties
+	mp2p.properties = properties
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case cmd := <-mp2p.commands:
+				cmd.result <- cmd.action()
+			case <-mp2.quit:
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			if err := mp2.update(); err != nil {
+				t.Errorf("update: %v", err)
+			}
+			if err := mp2p.update(); err != nil {
+				t.Errorf("update: %v", err)
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+	})
+	return &testBridge{mp2: mp2, mp2p: mp2p, properties: properties}
+}
+
+// TestConcurrentCalls runs methods, property writes and reads, and
+// Quit from many goroutines while the loop updates the properties.
+// It's meant to be run with -race.
+func TestConcurrentCalls(t *testing.T) {
+	b := newTestBridge(t)
+	const player = "org.mpris.MediaPlayer2.Player"
+
+	calls := []func() *dbus.Error{
+		b.mp2p.Play,
+		b.mp2p.Pause,
+		b.mp2p.PlayPause,
+		func() *dbus.Error { return b.mp2p.Seek(1000000) },
+		func() *dbus.Error {
+			return b.properties.Set(player, "Volume", dbus.MakeVariant(0.5))
+		},
+		func() *dbus.Error {
+			return b.properties.Set(player, "Shuffle", dbus.MakeVariant(true))
+		},
+		func() *dbus.Error {
+			return b.properties.Set(player, "LoopStatus", dbus.MakeVariant("Playlist"))
+		},
+		func() *dbus.Error {
+			_, err := b.properties.Get(player, "Position")
+			return err
+		},
+		func() *dbus.Error {
+			_, err := b.properties.GetAll(player)
+			return err
+		},
+		func() *dbus.Error {
+			_, err := b.properties.Get("org.mpris.MediaPlayer2", "CanQuit")
+			return err
+		},
+		b.mp2.Quit,
+	}
+
+	var wg sync.WaitGroup
+	for _, call := range calls {
+		for range 4 {
+			wg.Go(func() {
+				for range 10 {
+					if err := call(); err != nil {
+						t.Errorf("%s: %v", err.Name, err.Body)
+					}
+				}
+			})
+		}
+	}
+	wg.Wait()
+}
+
+// TestSetDuringUpdates checks that a property write, whose setter waits
+// for the loop, returns while the loop keeps publishing: godbus would
+// run the setter holding the lock of the properties.
+func TestSetDuringUpdates(t *testing.T) {
+	b := newTestBridge(t)
+
+	done := make(chan *dbus.Error, 1)
+	go func() {
+		done <- b.properties.Set("org.mpris.MediaPlayer2.Player", "LoopStatus", dbus.MakeVariant("Track"))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("%s: %v", err.Name, err.Body)
+		}
+	case <-time.After(callTimeout):
+		t.Fatal("setting LoopStatus deadlocked with the updates")
+	}
+
+	// the loop publishes the new value after answering
+	var got any
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		value, err := b.properties.Get("org.mpris.MediaPlayer2.Player", "LoopStatus")
+		if err != nil {
+			t.Fatalf("%s: %v", err.Name, err.Body)
+		}
+		if got = value.Value(); got == "Track" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("LoopStatus is %v after setting Track", got)
+}
+
+// TestQuitReplies checks that a client calling Quit gets its reply
+// before the loop exits and closes the connection
+func TestQuitReplies(t *testing.T) {
+	fakeMocp(t)
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	client, err := dbus.ConnectSessionBus()
+	if err != nil {
+		t.Skipf("no session bus: %v", err)
+	}
+	defer client.Close()
+
+	cfg := DefaultConfig()
+	cfg.PlaylistDirs = nil
+	name := fmt.Sprintf("moc_mpris_bridge_test%d", os.Getpid())
+	done := make(chan error, 1)
+	go func() {
+		done <- MPRISLoop(name, "", cfg)
+	}()
+
+	busName := "org.mpris.MediaPlayer2." + name
+	for deadline := time.Now().Add(callTimeout); ; {
+		var owned bool
+		err := client.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, busName).Store(&owned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owned {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s wasn't registered", busName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	call := client.Object(busName, "/org/mpris/MediaPlayer2").Call("org.mpris.MediaPlayer2.Quit", 0)
+	if call.Err != nil {
+		t.Errorf("Quit: %v", call.Err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("the loop failed: %v", err)
+		}
+	case <-time.After(callTimeout):
+		t.Fatal("the loop didn't exit")
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+// playlist directories are scanned again at most this often
+const playlistScanInterval = 30 * time.Second
+
+var playlistOrderings = []string{"Alphabetical", "ModifiedDate", "UserDefined"}
+
+// Playlist is the (oss) struct of the MPRIS Playlists interface
+type Playlist struct {
+	Id   dbus.ObjectPath
+	Name string
+	Icon string
+}
+
+// MaybePlaylist is the (b(oss)) struct of the ActivePlaylist property
+type MaybePlaylist struct {
+	Valid    bool
+	Playlist Playlist
+}
+
+// noPlaylist is the ActivePlaylist while no playlist is active: the
+// struct still needs a valid object path
+var noPlaylist = MaybePlaylist{Playlist: Playlist{Id: "/"}}
+
+type playlistFile struct {
+	Playlist
+	path    string
+	modTime time.Time
+}
+
+type MediaPlayer2Playlists struct {
+	mp         *MocP
+	conn       *dbus.Conn
+	properties *Properties
+	player     *MediaPlayer2Player
+	dirs       []string
+	playlists  []playlistFile
+	active     MaybePlaylist
+	lastScan   time.Time
+}
+
+func NewMediaPlayer2Playlists(conn *dbus.Conn, mp *MocP, player *MediaPlayer2Player, cfg *Config) (*MediaPlayer2Playlists, error) {
+	mp2pl := &MediaPlayer2Playlists{}
+	mp2pl.mp = mp
+	mp2pl.conn = conn
+	mp2pl.player = player
+	mp2pl.configure(cfg)
+	mp2pl.active = noPlaylist
+	mp2pl.scan()
+
+	return mp2pl, nil
+}
+
+// configure applies the options of cfg; new directories are scanned
+// on the next update
+func (mp2pl *MediaPlayer2Playlists) configure(cfg *Config) {
+	mp2pl.dirs = cfg.PlaylistDirs
+	mp2pl.lastScan = time.Time{}
+}
+
+// props returns the properties of org.mpris.MediaPlayer2.Playlists
+func (mp2pl *MediaPlayer2Playlists) props() map[string]*prop.Prop {
+	return map[string]*prop.Prop{
+		"PlaylistCount":  newProp(uint32(len(mp2pl.playlists)), nil),
+		"Orderings":      newProp(playlistOrderings, nil),
+		"ActivePlaylist": newProp(mp2pl.active, nil),
+	}
+}
+
+// update scans the playlist directories again, if they weren't
+// scanned recently
+func (mp2pl *MediaPlayer2Playlists) update() error {
+	if time.Since(mp2pl.lastScan) < playlistScanInterval {
+		return nil
+	}
+	oldCount := len(mp2pl.playlists)
+	mp2pl.scan()
+	if len(mp2pl.playlists) != oldCount {
+		err := mp2pl.properties.publish("org.mpris.MediaPlayer2.Playlists", "PlaylistCount", uint32(len(mp2pl.playlists)))
+		if err != nil {
+			return err
+		}
+		log.Println("MediaPlayer2.Playlists.PlaylistCount was updated")
+	}
+	if mp2pl.active.Valid && mp2pl.find(mp2pl.active.Playlist.Id) == nil {
+		return mp2pl.setActive(noPlaylist)
+	}
+	return nil
+}
+
+// scan lists the m3u/pls files in the playlist directories, leaving
+// out the playlist mocp keeps for itself
+func (mp2pl *MediaPlayer2Playlists) scan() {
+	mp2pl.lastScan = time.Now()
+	mocPlaylist := filepath.Join(MocDir(), "playlist.m3u")
+	var playlists []playlistFile
+	for _, dir := range mp2pl.dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if entry.IsDir() || !isPlaylist(path) || path == mocPlaylist {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+			playlists = append(playlists, playlistFile{
+				Playlist: Playlist{Id: playlistID(path), Name: name},
+				path:     path,
+				modTime:  info.ModTime(),
+			})
+		}
+	}
+	mp2pl.playlists = playlists
+}
+
+func (mp2pl *MediaPlayer2Playlists) find(id dbus.ObjectPath) *playlistFile {
+	for i := range mp2pl.playlists {
+		if mp2pl.playlists[i].Id == id {
+			return &mp2pl.playlists[i]
+		}
+	}
+	return nil
+}
+
+func (mp2pl *MediaPlayer2Playlists) setActive(active MaybePlaylist) error {
+	mp2pl.active = active
+	err := mp2pl.properties.publish("org.mpris.MediaPlayer2.Playlists", "ActivePlaylist", active)
+	if err != nil {
+		return err
+	}
+	log.Println("MediaPlayer2.Playlists.ActivePlaylist was updated")
+	return nil
+}
+
+// Methods
+
+func (mp2pl *MediaPlayer2Playlists) ActivatePlaylist(playlistId dbus.ObjectPath) *dbus.Error {
+	err := mp2pl.player.do(func() error {
+		log.Println("MediaPlayer2.Playlists.ActivatePlaylist was called")
+		playlist := mp2pl.find(playlistId)
+		if playlist == nil {
+			return fmt.Errorf("unknown playlist %s", playlistId)
+		}
+		files, err := readPlaylist(playlist.path)
+		if err != nil {
+			return err
+		}
+		// clearing needs the server, which Open would start too late
+		if err := mp2pl.mp.ensureServer(); err != nil {
+			return err
+		}
+		if err := mp2pl.mp.Clear(); err != nil {
+			return err
+		}
+		if err := mp2pl.mp.Open(files); err != nil {
+			return err
+		}
+		return mp2pl.setActive(MaybePlaylist{Valid: true, Playlist: playlist.Playlist})
+	})
+
+	if err != nil {
+		return makeError(err)
+	}
+	return nil
+}
+
+func (mp2pl *MediaPlayer2Playlists) GetPlaylists(index uint32, maxCount uint32, order string, reverseOrder bool) ([]Playlist, *dbus.Error) {
+	var result []Playlist
+	err := mp2pl.player.query(func() error {
+		log.Println("MediaPlayer2.Playlists.GetPlaylists was called")
+		playlists := slices.Clone(mp2pl.playlists)
+		switch order {
+		case "Alphabetical":
+			slices.SortStableFunc(playlists, func(a, b playlistFile) int {
+				return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+			})
+		case "ModifiedDate":
+			slices.SortStableFunc(playlists, func(a, b playlistFile) int {
+				return a.modTime.Compare(b.modTime)
+			})
+		default:
+			// UserDefined: the order of the directories
+		}
+		if reverseOrder {
+			slices.Reverse(playlists)
+		}
+
+		start := min(int(index), len(playlists))
+		end := min(start+int(maxCount), len(playlists))
+		result = make([]Playlist, 0, end-start)
+		for _, playlist := range playlists[start:end] {
+			result = append(result, playlist.Playlist)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, makeError(err)
+	}
+	return result, nil
+}
+
+// playlistID derives a stable object path from the playlist's path
+func playlistID(path string) dbus.ObjectPath {
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	return dbus.ObjectPath(fmt.Sprintf("/org/moc_mpris_bridge/playlist/%016x", h.Sum64()))
+}
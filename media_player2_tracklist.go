@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const noTrack = dbus.ObjectPath("/org/mpris/MediaPlayer2/TrackList/NoTrack")
+
+type MediaPlayer2TrackList struct {
+	mp         *MocP
+	conn       *dbus.Conn
+	properties *Properties
+	player     *MediaPlayer2Player
+	tracks     []MocTrack
+	ids        []dbus.ObjectPath
+	metadata   map[dbus.ObjectPath]map[string]any
+	current    dbus.ObjectPath
+	stale      bool
+}
+
+func NewMediaPlayer2TrackList(conn *dbus.Conn, mp *MocP, player *MediaPlayer2Player) (*MediaPlayer2TrackList, error) {
+	mp2t := &MediaPlayer2TrackList{}
+	mp2t.mp = mp
+	mp2t.conn = conn
+	mp2t.player = player
+	mp2t.metadata = make(map[dbus.ObjectPath]map[string]any)
+
+	if err := mp.RefreshTracks(); err != nil {
+		return nil, err
+	}
+	mp2t.setTracks()
+
+	return mp2t, nil
+}
+
+// props returns the properties of org.mpris.MediaPlayer2.TrackList
+func (mp2t *MediaPlayer2TrackList) props() map[string]*prop.Prop {
+	return map[string]*prop.Prop{
+		// changes to Tracks are announced by the TrackList signals
+		"Tracks": {
+			Value:    slices.Clone(mp2t.ids),
+			Writable: false,
+			Emit:     prop.EmitInvalidates,
+			Callback: nil,
+		},
+		"CanEditTracks": newProp(true, nil),
+	}
+}
+
+// invalidate makes the next update fetch the playlist again
+func (mp2t *MediaPlayer2TrackList) invalidate() {
+	mp2t.stale = true
+}
+
+// refresh fetches the playlist again if it was invalidated. It runs
+// before the player's update, whose capabilities depend on the
+// playlist.
+func (mp2t *MediaPlayer2TrackList) refresh() error {
+	if !mp2t.stale {
+		return nil
+	}
+	if err := mp2t.mp.RefreshTracks(); err != nil {
+		return err
+	}
+	mp2t.stale = false
+	return nil
+}
+
+// update signals the differences between the refreshed playlist and
+// the previous one. Ids can also change without a refresh, when the
+// current track starts over.
+func (mp2t *MediaPlayer2TrackList) update() error {
+	if _, ids := mp2t.mp.Tracks(); slices.Equal(ids, mp2t.ids) {
+		return mp2t.updateMetadata()
+	}
+	oldIds := mp2t.ids
+	mp2t.setTracks()
+	if slices.Equal(oldIds, mp2t.ids) {
+		return mp2t.updateMetadata()
+	}
+
+	err := mp2t.properties.publish("org.mpris.MediaPlayer2.TrackList", "Tracks", slices.Clone(mp2t.ids))
+	if err != nil {
+		return err
+	}
+	if err := mp2t.signalChanges(oldIds); err != nil {
+		return err
+	}
+	log.Println("MediaPlayer2.TrackList.Tracks was updated")
+	return nil
+}
+
+func (mp2t *MediaPlayer2TrackList) setTracks() {
+	tracks, ids := mp2t.mp.Tracks()
+	mp2t.tracks = tracks
+	mp2t.ids = slices.Clone(ids)
+	mp2t.current = mp2t.currentID()
+	metadata := make(map[dbus.ObjectPath]map[string]any, len(tracks))
+	for i, id := range mp2t.ids {
+		metadata[id] = mp2t.trackMetadata(i)
+	}
+	mp2t.metadata = metadata
+}
+
+// signalChanges emits TrackAdded or TrackRemoved when entries were
+// only appended or only removed, and TrackListReplaced otherwise
+func (mp2t *MediaPlayer2TrackList) signalChanges(oldIds []dbus.ObjectPath) error {
+	newIds := mp2t.ids
+	switch {
+	case len(oldIds) > 0 && len(newIds) > len(oldIds) && slices.Equal(oldIds, newIds[:len(oldIds)]):
+		for i := len(oldIds); i < len(newIds); i++ {
+			err := mp2t.TrackAdded(mp2t.metadata[newIds[i]], newIds[i-1])
+			if err != nil {
+				return err
+			}
+		}
+	case len(newIds) < len(oldIds) && isSubsequence(newIds, oldIds):
+		for _, id := range oldIds {
+			if slices.Contains(newIds, id) {
+				continue
+			}
+			if err := mp2t.TrackRemoved(id); err != nil {
+				return err
+			}
+		}
+	default:
+		return mp2t.TrackListReplaced(newIds, mp2t.current)
+	}
+	return nil
+}
+
+// updateMetadata signals the entries whose metadata changed. Between
+// playlist refreshes, only the current track and the one played
+// before it can change.
+func (mp2t *MediaPlayer2TrackList) updateMetadata() error {
+	previous := mp2t.current
+	mp2t.current = mp2t.currentID()
+	for _, id := range []dbus.ObjectPath{previous, mp2t.current} {
+		i := slices.Index(mp2t.ids, id)
+		if i < 0 {
+			continue
+		}
+		metadata := mp2t.trackMetadata(i)
+		if reflect.DeepEqual(metadata, mp2t.metadata[id]) {
+			continue
+		}
+		mp2t.metadata[id] = metadata
+		if err := mp2t.TrackMetadataChanged(id, metadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trackMetadata returns the metadata of the i-th entry; the current
+// track gets the full metadata of the player
+func (mp2t *MediaPlayer2TrackList) trackMetadata(i int) map[string]any {
+	id := mp2t.ids[i]
+	if id == mp2t.current {
+		return mp2t.mp.GetMetadata()
+	}
+
+	track := mp2t.tracks[i]
+	metadata := map[string]any{
+		"mpris:trackid": id,
+		"xesam:url":     track.File,
+	}
+	if track.Tags.Title != "" {
+		metadata["xesam:title"] = track.Tags.Title
+	} else if track.TitleTags != "" {
+		metadata["xesam:title"] = track.TitleTags
+	}
+	if track.Tags.Artist != "" {
+		metadata["xesam:artist"] = mp2t.mp.SplitValues(track.Tags.Artist)
+	}
+	if track.Tags.Album != "" {
+		metadata["xesam:album"] = track.Tags.Album
+	}
+	if track.Tags.Time >= 0 {
+		metadata["mpris:length"] = int64(track.Tags.Time) * 1000000
+	}
+	return metadata
+}
+
+// currentID returns the id of the current track, if it's an entry of
+// the track list
+func (mp2t *MediaPlayer2TrackList) currentID() dbus.ObjectPath {
+	id := mp2t.mp.TrackID()
+	if !slices.Contains(mp2t.ids, id) {
+		return noTrack
+	}
+	return id
+}
+
+func (mp2t *MediaPlayer2TrackList) find(trackId dbus.ObjectPath) (MocTrack, bool) {
+	i := slices.Index(mp2t.ids, trackId)
+	if i < 0 {
+		return MocTrack{}, false
+	}
+	return mp2t.tracks[i], true
+}
+
+// Methods
+
+func (mp2t *MediaPlayer2TrackList) GetTracksMetadata(trackIds []dbus.ObjectPath) ([]map[string]any, *dbus.Error) {
+	var result []map[string]any
+	err := mp2t.player.query(func() error {
+		log.Println("MediaPlayer2.TrackList.GetTracksMetadata was called")
+		for _, id := range trackIds {
+			if metadata, ok := mp2t.metadata[id]; ok {
+				result = append(result, metadata)
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, makeError(err)
+	}
+	return result, nil
+}
+
+// AddTrack appends uri to the playlist: MOC can't insert a file at a
+// given position, so afterTrack is ignored
+func (mp2t *MediaPlayer2TrackList) AddTrack(uri string, afterTrack dbus.ObjectPath, setAsCurrent bool) *dbus.Error {
+	err := mp2t.player.do(func() error {
+		log.Println("MediaPlayer2.TrackList.AddTrack was called")
+		files, err := resolveUri(uri)
+		if err != nil {
+			return err
+		}
+		mp2t.invalidate()
+		return mp2t.mp.Insert(files, afterTrack, setAsCurrent)
+	})
+
+	if err != nil {
+		return makeError(err)
+	}
+	return nil
+}
+
+func (mp2t *MediaPlayer2TrackList) RemoveTrack(trackId dbus.ObjectPath) *dbus.Error {
+	err := mp2t.player.do(func() error {
+		log.Println("MediaPlayer2.TrackList.RemoveTrack was called")
+		track, ok := mp2t.find(trackId)
+		if !ok {
+			return fmt.Errorf("unknown track %s", trackId)
+		}
+		mp2t.invalidate()
+		return mp2t.mp.Remove(track)
+	})
+
+	if err != nil {
+		return makeError(err)
+	}
+	return nil
+}
+
+func (mp2t *MediaPlayer2TrackList) GoTo(trackId dbus.ObjectPath) *dbus.Error {
+	err := mp2t.player.do(func() error {
+		log.Println("MediaPlayer2.TrackList.GoTo was called")
+		track, ok := mp2t.find(trackId)
+		if !ok {
+			return fmt.Errorf("unknown track %s", trackId)
+		}
+		return mp2t.mp.PlayFile(track.File)
+	})
+
+	if err != nil {
+		return makeError(err)
+	}
+	return nil
+}
+
+// Signals
+
+func (mp2t *MediaPlayer2TrackList) TrackListReplaced(tracks []dbus.ObjectPath, currentTrack dbus.ObjectPath) error {
+	log.Println("MediaPlayer2.TrackList.TrackListReplaced was signalled")
+	return mp2t.conn.Emit("/org/mpris/MediaPlayer2", "org.mpris.MediaPlayer2.TrackList.TrackListReplaced", tracks, currentTrack)
+}
+
+func (mp2t *MediaPlayer2TrackList) TrackAdded(metadata map[string]any, afterTrack dbus.ObjectPath) error {
+	log.Println("MediaPlayer2.TrackList.TrackAdded was signalled")
+	return mp2t.conn.Emit("/org/mpris/MediaPlayer2", "org.mpris.MediaPlayer2.TrackList.TrackAdded", metadata, afterTrack)
+}
+
+func (mp2t *MediaPlayer2TrackList) TrackRemoved(trackId dbus.ObjectPath) error {
+	log.Println("MediaPlayer2.TrackList.TrackRemoved was signalled")
+	return mp2t.conn.Emit("/org/mpris/MediaPlayer2", "org.mpris.MediaPlayer2.TrackList.TrackRemoved", trackId)
+}
+
+func (mp2t *MediaPlayer2TrackList) TrackMetadataChanged(trackId dbus.ObjectPath, metadata map[string]any) error {
+	log.Println("MediaPlayer2.TrackList.TrackMetadataChanged was signalled")
+	return mp2t.conn.Emit("/org/mpris/MediaPlayer2", "org.mpris.MediaPlayer2.TrackList.TrackMetadataChanged", trackId, metadata)
+}
+
+// isSubsequence reports whether sub is s with some elements removed
+func isSubsequence[T comparable](sub, s []T) bool {
+	i := 0
+	for _, v := range s {
+		if i < len(sub) && sub[i] == v {
+			i++
+		}
+	}
+	return i == len(sub)
+}
@@ -1,24 +1,55 @@
 package main
 
 import (
-	"encoding/base64"
+	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"math"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/dhowden/tag"
 	"github.com/godbus/dbus/v5"
 )
 
 type MocP struct {
-	metadata map[string]any
+	// cancelled when the bridge exits, stopping the commands left
+	ctx        context.Context
+	metadata   map[string]any
+	client     *MocClient
+	separators []string
+	art        *ArtCache
+
+	// the MOC server, and whether clients may start it
+	server    serverState
+	autoStart bool
+
+	// single track repeat is emulated by the bridge
+	repeatTrack   bool
+	savedRepeat   bool
+	savedAutoNext bool
+	lastFile      string
+	lastTimeLeft  time.Duration
+
+	// tags read from the current file, and its album in the art cache
+	tags     FileTags
+	tagsFile string
+	artAlbum string
+
+	// playlist followed by the queue, and the ids of their entries
+	tracks   []MocTrack
+	trackIDs []dbus.ObjectPath
+	// index of the entry being played, -1 when it isn't known
+	playing int
+	// how many times each file started over right after itself
+	repeats map[string]int
 }
 
 const (
@@ -36,9 +67,20 @@ const (
 	Bitrate     = "Bitrate"
 	AvgBitrate  = "AvgBitrate"
 	Rate        = "Rate"
-	ArtURI      = "ArtURI"
+	// server options, not part of mocp -i
+	Shuffle  = "Shuffle"
+	Repeat   = "Repeat"
+	AutoNext = "AutoNext"
 )
 
+// lastTimeLeft of streams and stopped files
+const unknownTimeLeft = time.Duration(-1)
+
+// external commands are killed after this long
+const commandTimeout = 5 * time.Second
+
+var mocpOptions = []string{Shuffle, Repeat, AutoNext}
+
 var mocpInfoKeys = map[string]bool{
 	State:       true,
 	File:        true,
@@ -56,26 +98,311 @@ var mocpInfoKeys = map[string]bool{
 	Rate:        true,
 }
 
-func NewMocP() (*MocP, error) {
+func NewMocP(ctx context.Context, cfg *Config) (*MocP, error) {
 	metadata := make(map[string]any)
-	mp := &MocP{metadata: metadata}
-	err := mp.UpdateInfo()
-	if err != nil {
-		return nil, err
+	mp := &MocP{ctx: ctx, metadata: metadata, repeats: make(map[string]int), lastTimeLeft: unknownTimeLeft, playing: -1}
+	mp.art = NewArtCache(cfg)
+	mp.configure(cfg)
+	// a bad state isn't fatal, the loop will try again
+	if err := mp.UpdateInfo(); err != nil {
+		log.Printf("couldn't read the state of mocp: %v", err)
 	}
 
 	return mp, nil
 }
 
+// configure applies the options of cfg, at startup or when the
+// configuration is reloaded
+func (mp *MocP) configure(cfg *Config) {
+	mp.separators = cfg.ArtistSeparators
+	mp.art.configure(cfg)
+	mp.autoStart = cfg.StartServer
+}
+
+// Close releases the connection to the MOC server, if any, after
+// giving MOC its options back
+func (mp *MocP) Close() error {
+	if mp == nil {
+		return nil
+	}
+	if err := mp.leaveTrackRepeat(); err != nil {
+		log.Printf("couldn't restore MOC options: %v", err)
+	}
+	if mp.client == nil {
+		return nil
+	}
+	err := mp.client.Close()
+	mp.client = nil
+	return err
+}
+
 func (mp *MocP) Append(files []string) error {
 	if mp == nil {
 		return nil
 	}
 	args := []string{"-a"}
 	args = append(args, files...)
-	cmd := exec.Command("mocp", args...)
+	return mp.mocp(args...)
+}
+
+// Open appends files to the playlist and starts playing the first one
+func (mp *MocP) Open(files []string) error {
+	if mp == nil || len(files) == 0 {
+		return nil
+	}
+	if err := mp.ensureServer(); err != nil {
+		return err
+	}
+	if err := mp.Append(files); err != nil {
+		return err
+	}
+	return mp.PlayFile(files[0])
+}
+
+// Insert adds files to the playlist right after the entry whose id is
+// after, or at the beginning for noTrack, and plays the first one if
+// play is set. MOC can only append files, so the new entries are then
+// moved into place over the socket. MOC finds the entries to move by
+// file, so none of them may appear twice on the playlist.
+func (mp *MocP) Insert(files []string, after dbus.ObjectPath, play bool) error {
+	if mp == nil || len(files) == 0 {
+		return nil
+	}
+	if err := mp.ensureServer(); err != nil {
+		return err
+	}
+	if err := mp.RefreshTracks(); err != nil {
+		return err
+	}
+	target := -1
+	if after != noTrack {
+		target = slices.Index(mp.trackIDs, after)
+		if target < 0 || mp.tracks[target].Queued {
+			return fmt.Errorf("unknown track %s", after)
+		}
+	}
+	count := make(map[string]int)
+	var playlist []string
+	for _, track := range mp.tracks {
+		if !track.Queued {
+			playlist = append(playlist, track.File)
+			count[track.File]++
+		}
+	}
+	for _, file := range files {
+		count[file]++
+	}
+	for _, file := range append(slices.Clone(playlist[target+1:]), files...) {
+		if count[file] > 1 {
+			return fmt.Errorf("%s appears twice on the playlist, so it can't be moved", file)
+		}
+	}
 
-	return cmd.Run()
+	if err := mp.Append(files); err != nil {
+		return err
+	}
+	if err := mp.RefreshTracks(); err != nil {
+		return err
+	}
+	start := len(playlist)
+	playlist = playlist[:0]
+	for _, track := range mp.tracks {
+		if !track.Queued {
+			playlist = append(playlist, track.File)
+		}
+	}
+	if start >= len(playlist) {
+		// mocp added nothing it could play
+		return nil
+	}
+	first := playlist[start]
+	for _, swap := range insertSwaps(playlist, start, target+1) {
+		if !mp.native(func(c *MocClient) error { return c.Swap(swap[0], swap[1]) }) {
+			return errors.New("moving tracks needs the MOC server socket")
+		}
+	}
+	if play {
+		return mp.PlayFile(first)
+	}
+	return nil
+}
+
+// insertSwaps returns the swaps of neighbouring entries that move the
+// entries of playlist from start on to index at, in order
+func insertSwaps(playlist []string, start, at int) [][2]string {
+	playlist = slices.Clone(playlist)
+	var swaps [][2]string
+	for i := start; i < len(playlist); i, at = i+1, at+1 {
+		for p := i; p > at; p-- {
+			swaps = append(swaps, [2]string{playlist[p-1], playlist[p]})
+			playlist[p-1], playlist[p] = playlist[p], playlist[p-1]
+		}
+	}
+	return swaps
+}
+
+// MocTrack is an entry of the playlist or of the queue
+type MocTrack struct {
+	MocItem
+	Queued bool
+}
+
+// SplitValues splits a tag value holding several artists or genres
+func (mp *MocP) SplitValues(value string) []string {
+	if mp == nil {
+		return []string{value}
+	}
+	return splitValues(value, mp.separators)
+}
+
+// Tracks returns the playlist followed by the queue, as of the last
+// RefreshTracks, along with the ids of the entries
+func (mp *MocP) Tracks() ([]MocTrack, []dbus.ObjectPath) {
+	if mp == nil {
+		return nil, nil
+	}
+	return mp.tracks, mp.trackIDs
+}
+
+// RefreshTracks fetches the playlist and the queue again
+func (mp *MocP) RefreshTracks() error {
+	if mp == nil {
+		return nil
+	}
+	tracks, err := mp.fetchTracks()
+	if err != nil {
+		return err
+	}
+	mp.setTracks(tracks)
+	return nil
+}
+
+// setTracks replaces the playlist and the queue, following the entry
+// being played wherever it moved
+func (mp *MocP) setTracks(tracks []MocTrack) {
+	playing := -1
+	if mp.playing >= 0 {
+		file := mp.tracks[mp.playing].File
+		playing = nthEntry(tracks, file, occurrence(mp.tracks, mp.playing))
+	}
+	mp.tracks, mp.playing = tracks, playing
+	mp.computeTrackIDs()
+}
+
+// TrackID returns the id of the current track. Files played from the
+// queue leave it when they start, so they may not have an entry: their
+// id is derived from the file alone.
+func (mp *MocP) TrackID() dbus.ObjectPath {
+	if mp == nil {
+		return noTrack
+	}
+	file, ok := mp.metadata[File].(string)
+	if !ok {
+		return noTrack
+	}
+	if i := mp.currentEntry(); i >= 0 {
+		return mp.trackIDs[i]
+	}
+	return trackID(file, -1, mp.repeats[file])
+}
+
+// currentEntry returns the index of the entry of the playlist being
+// played, or -1 if the current file isn't on the playlist. When the
+// bridge lost track of it, the first entry of the file is assumed.
+func (mp *MocP) currentEntry() int {
+	file, _ := mp.metadata[File].(string)
+	if isEntry(mp.tracks, mp.playing, file) {
+		return mp.playing
+	}
+	return nthEntry(mp.tracks, file, 0)
+}
+
+// followEntry finds the entry of the playlist being played after MOC
+// moved to file. MOC moves to the entry next to the one it was playing,
+// unless shuffling, and plays the first entry of a file it's asked to
+// play.
+func (mp *MocP) followEntry(file string) {
+	switch i := mp.playing; {
+	case i < 0:
+		mp.playing = nthEntry(mp.tracks, file, 0)
+	case isEntry(mp.tracks, i, file):
+	case isEntry(mp.tracks, i+1, file):
+		mp.playing = i + 1
+	case isEntry(mp.tracks, i-1, file):
+		mp.playing = i - 1
+	default:
+		mp.playing = nthEntry(mp.tracks, file, 0)
+	}
+}
+
+// computeTrackIDs gives every entry a deterministic object path,
+// derived from its file and from how many times the file appears
+// before it, so that adding or removing other entries doesn't change
+// it. An entry gets a new id every time its file starts over.
+func (mp *MocP) computeTrackIDs() {
+	seen := make(map[string]int)
+	ids := make([]dbus.ObjectPath, len(mp.tracks))
+	for i, track := range mp.tracks {
+		key := track.File
+		if track.Queued {
+			key = "queue\x00" + key
+		}
+		ids[i] = trackID(key, seen[key], mp.repeats[track.File])
+		seen[key]++
+	}
+	mp.trackIDs = ids
+}
+
+// fetchTracks returns MOC's playlist followed by its queue. Without
+// the mocp interface running, the playlist saved in the MOC directory
+// is the current one.
+func (mp *MocP) fetchTracks() ([]MocTrack, error) {
+	var tracks []MocTrack
+	if mp.native(func(c *MocClient) error {
+		playlist, ok, err := c.GetPlaylist()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			playlist = readSavedPlaylist()
+		}
+		queue, err := c.GetQueue()
+		if err != nil {
+			return err
+		}
+		tracks = tracks[:0]
+		for _, item := range playlist {
+			tracks = append(tracks, MocTrack{MocItem: item})
+		}
+		for _, item := range queue {
+			tracks = append(tracks, MocTrack{MocItem: item, Queued: true})
+		}
+		return nil
+	}) {
+		return tracks, nil
+	}
+
+	for _, item := range readSavedPlaylist() {
+		tracks = append(tracks, MocTrack{MocItem: item})
+	}
+	return tracks, nil
+}
+
+// Remove removes a track from the playlist or from the queue
+func (mp *MocP) Remove(track MocTrack) error {
+	if mp == nil {
+		return nil
+	}
+	if mp.native(func(c *MocClient) error {
+		if track.Queued {
+			return c.Unqueue(track.File)
+		}
+		return c.Delete(track.File)
+	}) {
+		return nil
+	}
+	// mocp has no option to remove a file
+	return errors.New("removing tracks needs the MOC server socket")
 }
 
 func (mp *MocP) Enqueue(files []string) error {
@@ -84,128 +411,176 @@ func (mp *MocP) Enqueue(files []string) error {
 	}
 	args := []string{"-q"}
 	args = append(args, files...)
-	cmd := exec.Command("mocp", args...)
-
-	return cmd.Run()
+	return mp.mocp(args...)
 }
 
 func (mp *MocP) ToggleShuffle() error {
 	if mp == nil {
 		return nil
 	}
-	cmd := exec.Command("mocp", "-t", "shuffle")
-	return cmd.Run()
+	if mp.native(func(c *MocClient) error { return toggleOption(c, Shuffle) }) {
+		return nil
+	}
+	return mp.mocp("-t", "shuffle")
 }
 
 func (mp *MocP) ToggleAutoNext() error {
 	if mp == nil {
 		return nil
 	}
-	cmd := exec.Command("mocp", "-t", "autonext")
-	return cmd.Run()
+	if mp.native(func(c *MocClient) error { return toggleOption(c, AutoNext) }) {
+		return nil
+	}
+	return mp.mocp("-t", "autonext")
 }
 
 func (mp *MocP) ToggleRepeat() error {
 	if mp == nil {
 		return nil
 	}
-	cmd := exec.Command("mocp", "-t", "repeat")
-	return cmd.Run()
+	if mp.native(func(c *MocClient) error { return toggleOption(c, Repeat) }) {
+		return nil
+	}
+	return mp.mocp("-t", "repeat")
 }
 
 func (mp *MocP) SetShuffle(on bool) error {
 	if mp == nil {
 		return nil
 	}
-	var cmd *exec.Cmd
-	if on {
-		cmd = exec.Command("mocp", "-o", "shuffle")
-	} else {
-		cmd = exec.Command("mocp", "-u", "shuffle")
+	if !mp.native(func(c *MocClient) error { return c.SetOption(Shuffle, on) }) {
+		flag := "-u"
+		if on {
+			flag = "-o"
+		}
+		if err := mp.mocp(flag, "shuffle"); err != nil {
+			return err
+		}
 	}
-	return cmd.Run()
+	mp.metadata[Shuffle] = on
+	return nil
 }
 
 func (mp *MocP) SetAutoNext(on bool) error {
 	if mp == nil {
 		return nil
 	}
-	var cmd *exec.Cmd
-	if on {
-		cmd = exec.Command("mocp", "-o", "autonext")
-	} else {
-		cmd = exec.Command("mocp", "-u", "autonext")
+	if !mp.native(func(c *MocClient) error { return c.SetOption(AutoNext, on) }) {
+		flag := "-u"
+		if on {
+			flag = "-o"
+		}
+		if err := mp.mocp(flag, "autonext"); err != nil {
+			return err
+		}
 	}
-	return cmd.Run()
+	mp.metadata[AutoNext] = on
+	return nil
 }
 
 func (mp *MocP) SetRepeat(on bool) error {
 	if mp == nil {
 		return nil
 	}
-	var cmd *exec.Cmd
-	if on {
-		cmd = exec.Command("mocp", "-o", "repeat")
-	} else {
-		cmd = exec.Command("mocp", "-u", "repeat")
+	if !mp.native(func(c *MocClient) error { return c.SetOption(Repeat, on) }) {
+		flag := "-u"
+		if on {
+			flag = "-o"
+		}
+		if err := mp.mocp(flag, "repeat"); err != nil {
+			return err
+		}
 	}
-	return cmd.Run()
+	mp.metadata[Repeat] = on
+	return nil
 }
 
 func (mp *MocP) Clear() error {
 	if mp == nil {
 		return nil
 	}
-	cmd := exec.Command("mocp", "-c")
-	return cmd.Run()
+	return mp.mocp("-c")
 }
 
 func (mp *MocP) Previous() error {
 	if mp == nil {
 		return nil
 	}
-	cmd := exec.Command("mocp", "-r")
-	return cmd.Run()
+	mp.forgetTrack()
+	if mp.native(func(c *MocClient) error { return c.Prev() }) {
+		return nil
+	}
+	return mp.mocp("-r")
 }
 
 func (mp *MocP) Next() error {
 	if mp == nil {
 		return nil
 	}
-	cmd := exec.Command("mocp", "-f")
-	return cmd.Run()
+	mp.forgetTrack()
+	if mp.native(func(c *MocClient) error { return c.Next() }) {
+		return nil
+	}
+	return mp.mocp("-f")
 }
 
 func (mp *MocP) Stop() error {
 	if mp == nil {
 		return nil
 	}
-	cmd := exec.Command("mocp", "-s")
-	return cmd.Run()
+	mp.forgetTrack()
+	if mp.native(func(c *MocClient) error { return c.Stop() }) {
+		return nil
+	}
+	return mp.mocp("-s")
 }
 
 func (mp *MocP) Exit() error {
 	if mp == nil {
 		return nil
 	}
-	cmd := exec.Command("mocp", "-x")
-	return cmd.Run()
+	if mp.native(func(c *MocClient) error { return c.Quit() }) {
+		return nil
+	}
+	return mp.mocp("-x")
 }
 
 func (mp *MocP) Unpause() error {
 	if mp == nil {
 		return nil
 	}
-	cmd := exec.Command("mocp", "-U")
-	return cmd.Run()
+	if mp.native(func(c *MocClient) error { return c.Unpause() }) {
+		return nil
+	}
+	return mp.mocp("-U")
 }
 
+// Play always goes through mocp: starting playback from the stopped
+// state needs the playlist synchronisation implemented by the client.
 func (mp *MocP) Play() error {
 	if mp == nil {
 		return nil
 	}
-	cmd := exec.Command("mocp", "-p")
-	return cmd.Run()
+	mp.forgetTrack()
+	mp.playing = -1
+	if err := mp.ensureServer(); err != nil {
+		return err
+	}
+	return mp.mocp("-p")
+}
+
+// PlayFile starts playing file, which should be on the playlist. MOC
+// plays its first entry, even if the file appears several times.
+func (mp *MocP) PlayFile(file string) error {
+	if mp == nil {
+		return nil
+	}
+	mp.forgetTrack()
+	mp.playing = -1
+	if mp.native(func(c *MocClient) error { return c.PlayFile(file) }) {
+		return nil
+	}
+	return mp.mocp("-l", file)
 }
 
 func (mp *MocP) TogglePause() error {
@@ -224,24 +599,94 @@ func (mp *MocP) TogglePause() error {
 		if err != nil {
 			return err
 		}
+	case "Stopped":
+		err := mp.Play()
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func (mp *MocP) GetLoopStatus() string {
+	if mp == nil {
+		return "None"
+	}
+	if mp.repeatTrack {
+		return "Track"
+	}
+	// MOC only knows how to repeat the whole playlist
+	if repeat, _ := mp.metadata[Repeat].(bool); repeat {
+		return "Playlist"
+	}
 	return "None"
 }
 
+// SetLoopStatus sets the MPRIS loop status. "Track" is emulated: MOC
+// is told to stop at the end of the file, and the bridge plays it
+// again. Leaving "Track" gives MOC its own options back.
+func (mp *MocP) SetLoopStatus(status string) error {
+	if mp == nil {
+		return nil
+	}
+	switch status {
+	case "Track":
+		if mp.repeatTrack {
+			return nil
+		}
+		mp.savedRepeat, _ = mp.metadata[Repeat].(bool)
+		mp.savedAutoNext, _ = mp.metadata[AutoNext].(bool)
+		if err := mp.SetAutoNext(false); err != nil {
+			return err
+		}
+		if err := mp.SetRepeat(false); err != nil {
+			return err
+		}
+		mp.repeatTrack = true
+		return nil
+	case "None", "Playlist":
+		if err := mp.leaveTrackRepeat(); err != nil {
+			return err
+		}
+		return mp.SetRepeat(status == "Playlist")
+	default:
+		return fmt.Errorf("unknown loop status %q", status)
+	}
+}
+
+// leaveTrackRepeat ends the emulated single track repeat, giving MOC
+// back the repeat and autonext options it had before
+func (mp *MocP) leaveTrackRepeat() error {
+	if !mp.repeatTrack {
+		return nil
+	}
+	if err := mp.SetAutoNext(mp.savedAutoNext); err != nil {
+		return err
+	}
+	if err := mp.SetRepeat(mp.savedRepeat); err != nil {
+		return err
+	}
+	mp.repeatTrack = false
+	return nil
+}
+
 func (mp *MocP) GetShuffle() bool {
-	return false
+	if mp == nil {
+		return false
+	}
+	shuffle, _ := mp.metadata[Shuffle].(bool)
+	return shuffle
 }
 
 func (mp *MocP) Seek(seconds int) error {
 	if mp == nil {
 		return nil
 	}
-	cmd := exec.Command("mocp", "--seek", strconv.Itoa(seconds))
-	return cmd.Run()
+	mp.forgetTrack()
+	if mp.native(func(c *MocClient) error { return c.Seek(seconds) }) {
+		return nil
+	}
+	return mp.mocp("--seek", strconv.Itoa(seconds))
 }
 
 func (mp *MocP) Volume(val int) error {
@@ -258,31 +703,40 @@ func (mp *MocP) Volume(val int) error {
 		volume = val
 	}
 
-	cmd := exec.Command("mocp", "--volume", strconv.Itoa(volume))
-	return cmd.Run()
+	if mp.native(func(c *MocClient) error { return c.SetMixer(volume) }) {
+		return nil
+	}
+	return mp.mocp("--volume", strconv.Itoa(volume))
 }
 
+// Jump moves to the given second of the current file. It fails if the
+// file has no known length, or is shorter.
 func (mp *MocP) Jump(seconds int) error {
 	if mp == nil {
 		return nil
 	}
+	mp.forgetTrack()
 	totSec, ok := mp.GetInfo(TotalSec)
 	if !ok {
-		return nil
+		return errors.New("can't jump in a track of unknown length")
 	}
 	if seconds < 0 || seconds > totSec.(int) {
+		return fmt.Errorf("can't jump to %ds in a track of %ds", seconds, totSec)
+	}
+	if mp.native(func(c *MocClient) error { return c.JumpTo(seconds) }) {
 		return nil
 	}
-	cmd := exec.Command("mocp", "--jump", strconv.Itoa(seconds)+"s")
-	return cmd.Run()
+	return mp.mocp("--jump", strconv.Itoa(seconds)+"s")
 }
 
 func (mp *MocP) Pause() error {
 	if mp == nil {
 		return nil
 	}
-	cmd := exec.Command("mocp", "-P")
-	return cmd.Run()
+	if mp.native(func(c *MocClient) error { return c.Pause() }) {
+		return nil
+	}
+	return mp.mocp("-P")
 }
 
 func (mp *MocP) GetPlaybackStatus() string {
@@ -305,8 +759,15 @@ func (mp *MocP) GetPlaybackStatus() string {
 	}
 }
 
-// func (mp *MocP) GetLoopStatus(val string)
-// func (mp *MocP) SetLoopStatus(val string)
+// TimeLeft returns how long the current track plays on, as of the
+// last update; it's unknown when not playing or for streams
+func (mp *MocP) TimeLeft() (time.Duration, bool) {
+	if mp.GetPlaybackStatus() != "Playing" {
+		return 0, false
+	}
+	timeLeft, ok := mp.metadata[TimeLeft].(time.Duration)
+	return timeLeft, ok
+}
 
 func (mp *MocP) SetRate(val float64) error {
 	if mp == nil {
@@ -319,9 +780,6 @@ func (mp *MocP) SetRate(val float64) error {
 	return nil
 }
 
-// func (mp *MocP) GetShuffle
-// func (mp *MocP) SetShuffle
-
 func (mp *MocP) GetMetadata() map[string]any {
 	if mp == nil {
 		return nil
@@ -334,23 +792,20 @@ func (mp *MocP) GetMetadata() map[string]any {
 	if val, ok := mp.GetInfo(File); ok {
 		metadata["xesam:url"] = val
 	}
-	if val, ok := mp.GetInfo(ArtURI); ok {
-		metadata["mpris:artUrl"] = val
-	}
 	if val, ok := mp.GetInfo(SongTitle); ok {
 		metadata["xesam:title"] = val
 	}
 	if val, ok := mp.GetInfo(Artist); ok {
-		metadata["xesam:artist"] = val
+		metadata["xesam:artist"] = mp.SplitValues(val.(string))
 	}
 	if val, ok := mp.GetInfo(Album); ok {
 		metadata["xesam:album"] = val
 	}
-	metadata["mpris:trackid"] = dbus.ObjectPath("/org/moc_mpris_bridge/track/1")
-	// TODO: implement musicbrainz album art fetch
-	// if val, ok := mp.metadata[]; ok {
-	// 	metadata["mpris:artUrl"] = val
-	// }
+	if _, ok := mp.GetInfo(File); ok {
+		// values from the file itself are more complete than MOC's
+		mp.tags.metadata(metadata)
+	}
+	metadata["mpris:trackid"] = mp.TrackID()
 
 	return metadata
 }
@@ -359,7 +814,14 @@ func (mp *MocP) GetVolume() int {
 	if mp == nil {
 		return 0
 	}
-	vol, err := amixerGetVolume()
+	var mixer int
+	if mp.native(func(c *MocClient) (err error) {
+		mixer, err = c.GetMixer()
+		return err
+	}) {
+		return mixer
+	}
+	vol, err := amixerGetVolume(mp.ctx)
 	if err != nil {
 		return 0
 	}
@@ -381,57 +843,79 @@ func (mp *MocP) GetPosition() int {
 	return currSec
 }
 
+// CanGoNext reports whether Next changes the track: there must be a
+// queued file, or one after the current file on the playlist, unless
+// shuffle or repeat pick one anyway. MOC ignores Next while stopped.
 func (mp *MocP) CanGoNext() bool {
-	if mp == nil {
+	if mp == nil || !mp.loaded() {
 		return false
 	}
-	if _, ok := mp.GetInfo(SongTitle); ok {
-		return true
+	index, size := mp.playlistIndex()
+	for _, track := range mp.tracks {
+		if track.Queued {
+			return true
+		}
 	}
-	return false
+	return mp.wraps(size) || index+1 < size
 }
 
+// CanGoPrev reports whether Previous changes the track, like CanGoNext
 func (mp *MocP) CanGoPrev() bool {
-	if mp == nil {
+	if mp == nil || !mp.loaded() {
 		return false
 	}
-	if _, ok := mp.GetInfo(SongTitle); ok {
-		return true
-	}
-	return false
+	index, size := mp.playlistIndex()
+	return mp.wraps(size) || index > 0
 }
 
+// CanPlay reports whether there is something to play: a loaded file,
+// or a playlist to start from, regardless of tags
 func (mp *MocP) CanPlay() bool {
 	if mp == nil {
 		return false
 	}
-	if _, ok := mp.GetInfo(SongTitle); ok {
-		return true
-	}
-	return false
+	return mp.loaded() || len(mp.tracks) > 0
 }
 
+// CanPause is the same as CanPlay: MOC pauses streams as well
 func (mp *MocP) CanPause() bool {
-	if mp == nil {
-		return false
-	}
-	if _, ok := mp.GetInfo(SongTitle); ok {
-		return true
-	}
-	return false
+	return mp.CanPlay()
 }
 
+// CanSeek reports whether the loaded file can be seeked; streams have
+// no length
 func (mp *MocP) CanSeek() bool {
-	if mp == nil {
+	if mp == nil || !mp.loaded() {
 		return false
 	}
-	if _, ok := mp.GetInfo(CurrentSec); ok {
-		val, ok := mp.GetInfo(State)
-		if ok && val == "PLAY" {
-			return true
+	totalSec, _ := mp.metadata[TotalSec].(int)
+	return totalSec > 0
+}
+
+// loaded reports whether MOC is playing or paused on a file
+func (mp *MocP) loaded() bool {
+	_, ok := mp.metadata[File].(string)
+	return ok && mp.GetPlaybackStatus() != "Stopped"
+}
+
+// playlistIndex returns the index of the current entry on the playlist,
+// -1 if it isn't there, and the size of the playlist
+func (mp *MocP) playlistIndex() (int, int) {
+	size := 0
+	for _, track := range mp.tracks {
+		if !track.Queued {
+			size++
 		}
 	}
-	return false
+	return mp.currentEntry(), size
+}
+
+// wraps reports whether moving on from any file of a playlist of size
+// files lands on another one
+func (mp *MocP) wraps(size int) bool {
+	repeat, _ := mp.metadata[Repeat].(bool)
+	shuffle, _ := mp.metadata[Shuffle].(bool)
+	return (repeat && size > 0) || (shuffle && size > 1)
 }
 
 func (mp *MocP) GetInfo(key string) (any, bool) {
@@ -439,78 +923,302 @@ func (mp *MocP) GetInfo(key string) (any, bool) {
 	return val, ok
 }
 
+// UpdateInfo reads the state of MOC. If it can't be parsed, the
+// error is returned and the last good state is kept.
 func (mp *MocP) UpdateInfo() error {
 	if mp == nil {
 		return errors.New("must initialize mocp")
 	}
-	cmd := exec.Command("mocp", "-i")
-	data, err := cmd.CombinedOutput()
+	info, err := mp.readInfo()
 	if err != nil {
-		// mocp crashed, treat it as stopped
-		log.Print("mocp crashed, resetting...")
+		if !mp.serverGone() {
+			// keep the last good state
+			return err
+		}
+		// treat a missing server as stopped
 		clear(mp.metadata)
+		mp.playing = -1
 		return nil
 	}
-	// clean metadata, but keep a copy of file and artURI to avoid reencoding
-	file, artURI := mp.cacheArtURI()
-	clear(mp.metadata)
-	lines := strings.SplitSeq(string(data), "\n")
+	mp.setServer(serverConnected)
+	metadata := mp.readOptions()
+
+	for key, val := range info {
+		// streams leave the times empty
+		if !mocpInfoKeys[key] || val == "" {
+			continue
+		}
+		switch key {
+		case File:
+			// tags and artwork are read once per file
+			if val != mp.tagsFile {
+				mp.tags = readFileTags(val, mp.separators)
+				track := mp.artTrack(val, info)
+				mp.artAlbum = albumKey(val, track.Album)
+				mp.tags.ArtURI = mp.art.URL(mp.artAlbum, track)
+				mp.tags.picture = nil
+				mp.tagsFile = val
+			}
+			metadata[File] = val
+		case TotalTime, TimeLeft, CurrentTime:
+			durationVal, err := parseDuration(val)
+			if err != nil {
+				return fmt.Errorf("mocp %s %q: %w", key, val, err)
+			}
+			metadata[key] = durationVal
+		case TotalSec, CurrentSec:
+			secondVal, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("mocp %s %q: %w", key, val, err)
+			}
+			metadata[key] = secondVal
+		default:
+			metadata[key] = val
+		}
+	}
+	mp.metadata = metadata
+	file, _ := metadata[File].(string)
+	mp.followEntry(file)
+	return mp.followTrack()
+}
+
+// ArtResults delivers the cover art looked up in the background
+func (mp *MocP) ArtResults() <-chan ArtResult {
+	if mp == nil {
+		return nil
+	}
+	return mp.art.Results()
+}
+
+// SetArt stores cover art looked up in the background, and shows it if
+// it belongs to the current file
+func (mp *MocP) SetArt(res ArtResult) {
+	if mp == nil {
+		return
+	}
+	url := mp.art.Complete(res)
+	if url != "" && res.album == mp.artAlbum {
+		mp.tags.ArtURI = url
+	}
+}
+
+// artTrack describes file to the art providers, preferring the tags of
+// the file to what MOC reports
+func (mp *MocP) artTrack(file string, info map[string]string) ArtTrack {
+	track := ArtTrack{File: file, Album: mp.tags.Album, embedded: mp.tags.picture}
+	if track.Album == "" {
+		track.Album = info[Album]
+	}
+	switch {
+	case len(mp.tags.AlbumArtists) > 0:
+		track.Artist = mp.tags.AlbumArtists[0]
+	case len(mp.tags.Artists) > 0:
+		track.Artist = mp.tags.Artists[0]
+	default:
+		track.Artist = info[Artist]
+	}
+	return track
+}
+
+// followTrack notices when the current file starts over right after
+// reaching its end, which makes it a new track. It also plays the last
+// file again if it just reached its end while single track repeat is
+// on: MOC has either stopped, or moved on if its options were changed
+// behind our back. Only files whose time left is known can reach their
+// end, and the commands of the bridge make it forget the last file.
+func (mp *MocP) followTrack() error {
+	file, _ := mp.metadata[File].(string)
+	timeLeft, ok := mp.metadata[TimeLeft].(time.Duration)
+	if !ok {
+		timeLeft = unknownTimeLeft
+	}
+	nearEnd := mp.lastTimeLeft != unknownTimeLeft && mp.lastTimeLeft <= 2*time.Second
+	if file != "" && file == mp.lastFile && nearEnd && timeLeft > mp.lastTimeLeft {
+		mp.repeats[file]++
+		mp.computeTrackIDs()
+	}
+
+	ended := mp.lastFile != "" && file != mp.lastFile && nearEnd
+	if !mp.repeatTrack || !ended {
+		mp.lastFile, mp.lastTimeLeft = file, timeLeft
+		return nil
+	}
+
+	log.Printf("repeating %s", mp.lastFile)
+	mp.repeats[mp.lastFile]++
+	mp.computeTrackIDs()
+	return mp.PlayFile(mp.lastFile)
+}
+
+// forgetTrack stops followTrack from taking the change a command of
+// the bridge is about to make for the end of the last file
+func (mp *MocP) forgetTrack() {
+	mp.lastFile = ""
+	mp.lastTimeLeft = unknownTimeLeft
+}
 
+// readInfo returns the fields of `mocp -i`, asking the server directly
+// when possible
+func (mp *MocP) readInfo() (map[string]string, error) {
+	var info map[string]string
+	if mp.native(func(c *MocClient) (err error) {
+		info, err = c.Info()
+		return err
+	}) {
+		return info, nil
+	}
+
+	data, err := runCommand(mp.ctx, "mocp", "-i")
+	if err != nil {
+		return nil, err
+	}
+	info = make(map[string]string)
+	lines := strings.SplitSeq(string(data), "\n")
 	for l := range lines {
 		pairs := strings.SplitN(l, ":", 2)
 		if len(pairs) != 2 {
 			continue
 		}
-		key, val := pairs[0], pairs[1]
-		val = strings.TrimSpace(val)
-		if _, ok := mocpInfoKeys[key]; ok {
-			switch key {
-			case File:
-				// if file is the same, don't recalculate artwork
-				if val == file {
-					mp.metadata[ArtURI] = artURI
-				} else {
-					mp.metadata[ArtURI] = retrieveArtworkDataURI(val)
-				}
-				mp.metadata[File] = val
-			case TotalTime, TimeLeft, CurrentTime:
-				durationVal, err := parseDuration(val)
-				if err != nil {
-					return err
-				}
-				mp.metadata[key] = durationVal
-			case TotalSec, CurrentSec:
-				secondVal, err := strconv.Atoi(val)
-				if err != nil {
-					return err
-				}
-				mp.metadata[key] = secondVal
-			default:
-				mp.metadata[key] = val
+		info[pairs[0]] = strings.TrimSpace(pairs[1])
+	}
+	return info, nil
+}
+
+// readOptions returns the server options. mocp can't query them, so
+// without the socket the last known values are kept.
+func (mp *MocP) readOptions() map[string]any {
+	options := make(map[string]any)
+	if mp.native(func(c *MocClient) error {
+		for _, name := range mocpOptions {
+			on, err := c.GetOption(name)
+			if err != nil {
+				return err
 			}
+			options[name] = on
+		}
+		return nil
+	}) {
+		return options
+	}
+
+	for _, name := range mocpOptions {
+		if val, ok := mp.metadata[name]; ok {
+			options[name] = val
 		}
 	}
-	return nil
+	return options
 }
 
-func (mp *MocP) cacheArtURI() (string, string) {
-	if mp == nil {
-		return "", ""
+// native runs action over the MOC socket, connecting first if needed.
+// It returns false when the socket can't be used, in which case the
+// caller falls back to spawning mocp.
+func (mp *MocP) native(action func(c *MocClient) error) bool {
+	if mp.client == nil {
+		c, err := NewMocClient(MocSocketPath())
+		if err != nil {
+			return false
+		}
+		mp.client = c
+	}
+	if err := action(mp.client); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			stuckCommands.Add(1)
+		}
+		log.Printf("MOC socket failed, falling back to mocp: %v", err)
+		mp.client.Close()
+		mp.client = nil
+		return false
+	}
+	return true
+}
+
+// mocp runs mocp with args
+func (mp *MocP) mocp(args ...string) error {
+	_, err := runCommand(mp.ctx, "mocp", args...)
+	return err
+}
+
+// runCommand runs an external command and returns its output. The
+// command is killed after commandTimeout: a wedged MOC server or sound
+// device must not block the loop.
+func runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	// the server started by mocp may keep the output open
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		stuckCommands.Add(1)
+		limitedLog.Printf("%s %s was stuck and killed", name, strings.Join(args, " "))
+		return out, fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), errTimeout)
 	}
-	var file, artURI string
-	fileAny, ok1 := mp.GetInfo(File)
-	artURIAny, ok2 := mp.GetInfo(ArtURI)
+	return out, err
+}
+
+// albumKey identifies the album of file for the art cache
+func albumKey(file, album string) string {
+	return filepath.Dir(file) + "\x00" + album
+}
 
-	if ok1 && ok2 {
-		file, ok1 = fileAny.(string)
-		artURI, ok2 = artURIAny.(string)
+// isEntry reports whether the i-th track is an entry of file on the
+// playlist
+func isEntry(tracks []MocTrack, i int, file string) bool {
+	return i >= 0 && i < len(tracks) && !tracks[i].Queued && tracks[i].File == file
+}
+
+// occurrence returns how many times the file of the i-th track appears
+// on the playlist before it
+func occurrence(tracks []MocTrack, i int) int {
+	n := 0
+	for _, track := range tracks[:i] {
+		if !track.Queued && track.File == tracks[i].File {
+			n++
+		}
 	}
+	return n
+}
 
-	if ok1 && ok2 {
-		return file, artURI
+// nthEntry returns the index of the n-th entry of file on the playlist,
+// or -1
+func nthEntry(tracks []MocTrack, file string, n int) int {
+	for i, track := range tracks {
+		if track.Queued || track.File != file {
+			continue
+		}
+		if n == 0 {
+			return i
+		}
+		n--
 	}
+	return -1
+}
+
+func trackID(key string, occurrence int, repeats int) dbus.ObjectPath {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%d\x00%d", key, occurrence, repeats)
+	return dbus.ObjectPath(fmt.Sprintf("/org/moc_mpris_bridge/track/%016x", h.Sum64()))
+}
 
-	return "", ""
+// readSavedPlaylist reads the playlist mocp keeps in the MOC directory
+func readSavedPlaylist() []MocItem {
+	files, err := readPlaylist(filepath.Join(MocDir(), "playlist.m3u"))
+	if err != nil {
+		return nil
+	}
+	items := make([]MocItem, len(files))
+	for i, file := range files {
+		items[i] = MocItem{File: file, Tags: MocTags{Time: -1}}
+	}
+	return items
+}
+
+func toggleOption(c *MocClient, name string) error {
+	on, err := c.GetOption(name)
+	if err != nil {
+		return err
+	}
+	return c.SetOption(name, !on)
 }
 
 func parseDuration(duration string) (time.Duration, error) {
@@ -531,9 +1239,8 @@ func parseDuration(duration string) (time.Duration, error) {
 	return secondDuration, nil
 }
 
-func amixerGetVolume() (float64, error) {
-	cmd := exec.Command("amixer", "get", "Master")
-	out, err := cmd.CombinedOutput()
+func amixerGetVolume(ctx context.Context) (float64, error) {
+	out, err := runCommand(ctx, "amixer", "get", "Master")
 	if err != nil {
 		return 0, err
 	}
@@ -558,27 +1265,3 @@ func amixerGetVolume() (float64, error) {
 
 	return float64(volumes / len(matches)), nil
 }
-
-func retrieveArtworkDataURI(file string) string {
-	fd, err := os.Open(file)
-	if err != nil {
-		return ""
-	}
-	defer fd.Close()
-
-	m, err := tag.ReadFrom(fd)
-	if err != nil {
-		return ""
-	}
-
-	pic := m.Picture()
-	if pic == nil {
-		return ""
-	}
-
-	base64Encoding := base64.StdEncoding.EncodeToString(pic.Data)
-
-	uri := fmt.Sprintf("data:%s;base64,%s", pic.MIMEType, base64Encoding)
-
-	return uri
-}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func playlist(files ...string) []MocTrack {
+	tracks := make([]MocTrack, len(files))
+	for i, file := range files {
+		tracks[i] = MocTrack{MocItem: MocItem{File: file}}
+	}
+	return tracks
+}
+
+func TestTrackID(t *testing.T) {
+	a := trackID("/a.mp3", 0, 0)
+	for _, other := range []struct {
+		key               string
+		occurrence, times int
+	}{
+		{"/b.mp3", 0, 0},
+		{"/a.mp3", 1, 0},
+		{"/a.mp3", 0, 1},
+		{"/a.mp3", -1, 0},
+		{"queue\x00/a.mp3", 0, 0},
+	} {
+		if id := trackID(other.key, other.occurrence, other.times); id == a {
+			t.Errorf("trackID(%q, %d, %d) = trackID(%q, 0, 0)", other.key, other.occurrence, other.times, "/a.mp3")
+		}
+	}
+	if !a.IsValid() {
+		t.Errorf("trackID returned an invalid object path %q", a)
+	}
+	if id := trackID("/a.mp3", 0, 0); id != a {
+		t.Errorf("trackID isn't deterministic: %q != %q", id, a)
+	}
+}
+
+func TestComputeTrackIDs(t *testing.T) {
+	tracks := playlist("/a.mp3", "/b.mp3", "/a.mp3")
+	tracks = append(tracks, MocTrack{MocItem: MocItem{File: "/a.mp3"}, Queued: true})
+	mp := &MocP{tracks: tracks, repeats: map[string]int{"/b.mp3": 2}}
+	mp.computeTrackIDs()
+
+	want := []string{
+		string(trackID("/a.mp3", 0, 0)),
+		string(trackID("/b.mp3", 0, 2)),
+		string(trackID("/a.mp3", 1, 0)),
+		string(trackID("queue\x00/a.mp3", 0, 0)),
+	}
+	for i, id := range mp.trackIDs {
+		if string(id) != want[i] {
+			t.Errorf("entry %d: got %q, want %q", i, id, want[i])
+		}
+	}
+
+	// removing an entry keeps the ids of the others
+	mp.tracks = tracks[1:]
+	before := mp.trackIDs[1:]
+	mp.computeTrackIDs()
+	if mp.trackIDs[0] != before[0] {
+		t.Errorf("removing the first entry changed the id of the next one")
+	}
+}
+
+func TestFollowEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		tracks  []MocTrack
+		playing int
+		file    string
+		want    int
+	}{
+		{"unknown", playlist("/a", "/b", "/a"), -1, "/a", 0},
+		{"same entry", playlist("/a", "/b", "/a"), 2, "/a", 2},
+		{"next duplicate", playlist("/a", "/b", "/a"), 1, "/a", 2},
+		{"previous duplicate", playlist("/a", "/x", "/a", "/b"), 3, "/a", 2},
+		{"elsewhere", playlist("/a", "/b", "/c", "/a"), 1, "/a", 0},
+		{"not on the playlist", playlist("/a", "/b"), 0, "/c", -1},
+		{"stopped", playlist("/a", "/b"), 0, "", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mp := &MocP{tracks: tt.tracks, playing: tt.playing}
+			mp.followEntry(tt.file)
+			if mp.playing != tt.want {
+				t.Errorf("got %d, want %d", mp.playing, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackIDOfDuplicates(t *testing.T) {
+	mp := &MocP{
+		tracks:   playlist("/a", "/b", "/a"),
+		repeats:  map[string]int{},
+		metadata: map[string]any{File: "/b"},
+		playing:  -1,
+	}
+	mp.computeTrackIDs()
+	mp.followEntry("/b")
+	mp.metadata[File] = "/a"
+	mp.followEntry("/a")
+	if got := mp.TrackID(); got != mp.trackIDs[2] {
+		t.Errorf("got %q, want the id of the second entry %q", got, mp.trackIDs[2])
+	}
+
+	// the entry is followed when another one is added before it
+	mp.setTracks(playlist("/a", "/c", "/b", "/a"))
+	if got := mp.TrackID(); got != mp.trackIDs[3] {
+		t.Errorf("got %q, want the id of the last entry %q", got, mp.trackIDs[3])
+	}
+}
+
+func TestInsertSwaps(t *testing.T) {
+	tests := []struct {
+		name     string
+		playlist []string
+		start    int
+		at       int
+		want     []string
+	}{
+		{"beginning", []string{"a", "b", "x", "y"}, 2, 0, []string{"x", "y", "a", "b"}},
+		{"middle", []string{"a", "b", "c", "x", "y"}, 3, 1, []string{"a", "x", "y", "b", "c"}},
+		{"end", []string{"a", "b", "x"}, 2, 2, []string{"a", "b", "x"}},
+		{"empty", []string{"x", "y"}, 0, 0, []string{"x", "y"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := slices.Clone(tt.playlist)
+			for _, swap := range insertSwaps(tt.playlist, tt.start, tt.at) {
+				i, j := slices.Index(got, swap[0]), slices.Index(got, swap[1])
+				if j != i+1 {
+					t.Fatalf("swapping %q and %q, which aren't neighbours in %q", swap[0], swap[1], got)
+				}
+				got[i], got[j] = got[j], got[i]
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
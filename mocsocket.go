@@ -0,0 +1,701 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events sent by the MOC server (see protocol.h in the MOC sources)
+const (
+	evState      = 0x01
+	evCTime      = 0x02
+	evSrvError   = 0x04
+	evBusy       = 0x05
+	evData       = 0x06
+	evBitrate    = 0x07
+	evRate       = 0x08
+	evChannels   = 0x09
+	evExit       = 0x0a
+	evPong       = 0x0b
+	evOptions    = 0x0c
+	evSendPlist  = 0x0d
+	evTags       = 0x0e
+	evStatusMsg  = 0x0f
+	evMixer      = 0x10
+	evFileTags   = 0x11
+	evAvgBitrate = 0x12
+	evAudioStart = 0x13
+	evAudioStop  = 0x14
+	evPlistAdd   = 0x50
+	evPlistDel   = 0x51
+	evPlistMove  = 0x52
+	evPlistClear = 0x53
+	evQueueAdd   = 0x54
+	evQueueDel   = 0x55
+	evQueueMove  = 0x56
+	evQueueClear = 0x57
+)
+
+// Server states
+const (
+	statePlay  = 0x01
+	stateStop  = 0x02
+	statePause = 0x03
+)
+
+// Commands understood by the MOC server
+const (
+	cmdPlay          = 0x00
+	cmdStop          = 0x04
+	cmdPause         = 0x05
+	cmdUnpause       = 0x06
+	cmdSetOption     = 0x07
+	cmdGetOption     = 0x08
+	cmdGetCTime      = 0x0d
+	cmdGetSName      = 0x0f
+	cmdNext          = 0x10
+	cmdQuit          = 0x11
+	cmdSeek          = 0x12
+	cmdGetState      = 0x13
+	cmdDisconnect    = 0x15
+	cmdGetBitrate    = 0x16
+	cmdGetRate       = 0x17
+	cmdPing          = 0x19
+	cmdGetMixer      = 0x1a
+	cmdSetMixer      = 0x1b
+	cmdDelete        = 0x1c
+	cmdSendPlistEv   = 0x1d
+	cmdPrev          = 0x20
+	cmdGetPlist      = 0x22
+	cmdCliPlistDel   = 0x25
+	cmdLock          = 0x29
+	cmdUnlock        = 0x2a
+	cmdGetTags       = 0x2c
+	cmdCliPlistMove  = 0x31
+	cmdListMove      = 0x32
+	cmdGetAvgBitrate = 0x33
+	cmdJumpTo        = 0x3a
+	cmdQueueDel      = 0x3c
+	cmdGetQueue      = 0x3f
+)
+
+// maximum length of a string accepted from the server
+const mocMaxStrLen = 1 << 16
+
+// deadline applied to every request/response exchange
+const mocRequestTimeout = 2 * time.Second
+
+// MocTags are the tags of a file as reported by the MOC server
+type MocTags struct {
+	Title  string
+	Artist string
+	Album  string
+	Track  int
+	Time   int
+}
+
+// MocItem is an entry of the playlist or of the queue
+type MocItem struct {
+	File      string
+	TitleTags string
+	Tags      MocTags
+}
+
+// MocClient talks to the MOC server over its unix socket, using the
+// same binary protocol as mocp itself. Integers are sent as native
+// C ints, strings as a length followed by the bytes.
+type MocClient struct {
+	mu   sync.Mutex
+	conn net.Conn
+	// closed by Close, stopping the events of Watch
+	done chan struct{}
+}
+
+// MocDir returns the MOC directory, honouring the MOCDIR environment
+// variable.
+func MocDir() string {
+	dir := os.Getenv("MOCDIR")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".moc")
+	}
+	if strings.HasPrefix(dir, "~/") {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			dir = filepath.Join(home, dir[2:])
+		}
+	}
+	return dir
+}
+
+// MocSocketPath returns the path of the MOC server socket
+func MocSocketPath() string {
+	dir := MocDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "socket2")
+}
+
+func NewMocClient(socketPath string) (*MocClient, error) {
+	if socketPath == "" {
+		return nil, errors.New("no MOC socket path")
+	}
+	conn, err := net.DialTimeout("unix", socketPath, mocRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &MocClient{conn: conn, done: make(chan struct{})}, nil
+}
+
+func (c *MocClient) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return nil
+	default:
+		close(c.done)
+	}
+	// be polite, but don't care if the server is already gone
+	c.conn.SetDeadline(time.Now().Add(mocRequestTimeout))
+	c.sendInt(cmdDisconnect)
+	return c.conn.Close()
+}
+
+// Commands
+
+func (c *MocClient) Stop() error    { return c.command(cmdStop) }
+func (c *MocClient) Pause() error   { return c.command(cmdPause) }
+func (c *MocClient) Unpause() error { return c.command(cmdUnpause) }
+func (c *MocClient) Next() error    { return c.command(cmdNext) }
+func (c *MocClient) Prev() error    { return c.command(cmdPrev) }
+func (c *MocClient) Quit() error    { return c.command(cmdQuit) }
+
+func (c *MocClient) Seek(seconds int) error {
+	return c.command(cmdSeek, seconds)
+}
+
+func (c *MocClient) JumpTo(seconds int) error {
+	return c.command(cmdJumpTo, seconds)
+}
+
+func (c *MocClient) SetMixer(volume int) error {
+	return c.command(cmdSetMixer, volume)
+}
+
+// PlayFile starts playing file, which must be on the server's playlist.
+func (c *MocClient) PlayFile(file string) error {
+	return c.command(cmdPlay, file)
+}
+
+func (c *MocClient) SetOption(name string, on bool) error {
+	val := 0
+	if on {
+		val = 1
+	}
+	return c.command(cmdSetOption, name, val)
+}
+
+// Delete removes file from the playlist of the server and of the
+// clients, the same way the mocp interface does
+func (c *MocClient) Delete(file string) error {
+	return c.command(cmdLock, cmdCliPlistDel, file, cmdDelete, file, cmdUnlock)
+}
+
+// Swap exchanges the entries of file1 and file2 on the playlist of the
+// server and of the clients, which is how the mocp interface moves
+// entries
+func (c *MocClient) Swap(file1, file2 string) error {
+	return c.command(cmdLock, cmdCliPlistMove, file1, file2, cmdListMove, file1, file2, cmdUnlock)
+}
+
+func (c *MocClient) Unqueue(file string) error {
+	return c.command(cmdQueueDel, file)
+}
+
+func (c *MocClient) Ping() error {
+	return c.request(func() error {
+		if err := c.sendInt(cmdPing); err != nil {
+			return err
+		}
+		return c.waitFor(evPong)
+	})
+}
+
+// Watch dedicates the connection to the events broadcast by the
+// server: the returned channel receives the events relevant to the
+// bridge and is closed when the connection is lost or closed. Time
+// changes are coalesced, and no other request may be sent on the
+// client afterwards.
+func (c *MocClient) Watch() (<-chan int, error) {
+	err := c.request(func() error {
+		return c.sendInt(cmdSendPlistEv)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// events may be arbitrarily far apart
+	if err := c.conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	events := make(chan int, 1)
+	go func() {
+		defer close(events)
+		for {
+			ev, err := c.recvInt()
+			if err != nil {
+				return
+			}
+			if err := c.skipEventData(ev); err != nil {
+				return
+			}
+			switch ev {
+			case evExit:
+				return
+			case evCTime:
+				select {
+				case events <- ev:
+				default:
+					// an update is already pending
+				}
+			case evState, evTags, evOptions, evAvgBitrate, evMixer,
+				evAudioStart, evAudioStop,
+				evPlistAdd, evPlistDel, evPlistMove, evPlistClear,
+				evQueueAdd, evQueueDel, evQueueMove, evQueueClear:
+				select {
+				case events <- ev:
+				case <-c.done:
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Requests
+
+func (c *MocClient) GetState() (int, error)      { return c.requestInt(cmdGetState) }
+func (c *MocClient) GetCTime() (int, error)      { return c.requestInt(cmdGetCTime) }
+func (c *MocClient) GetBitrate() (int, error)    { return c.requestInt(cmdGetBitrate) }
+func (c *MocClient) GetAvgBitrate() (int, error) { return c.requestInt(cmdGetAvgBitrate) }
+func (c *MocClient) GetRate() (int, error)       { return c.requestInt(cmdGetRate) }
+func (c *MocClient) GetMixer() (int, error)      { return c.requestInt(cmdGetMixer) }
+
+func (c *MocClient) GetOption(name string) (bool, error) {
+	var val int
+	err := c.request(func() error {
+		if err := c.send(cmdGetOption, name); err != nil {
+			return err
+		}
+		if err := c.waitFor(evData); err != nil {
+			return err
+		}
+		var err error
+		val, err = c.recvInt()
+		return err
+	})
+	return val != 0, err
+}
+
+// GetPlaylist asks the server for the playlist held by the mocp
+// interface. ok is false when no interface is running.
+func (c *MocClient) GetPlaylist() (items []MocItem, ok bool, err error) {
+	err = c.request(func() error {
+		if err := c.sendInt(cmdGetPlist); err != nil {
+			return err
+		}
+		if err := c.waitFor(evData); err != nil {
+			return err
+		}
+		available, err := c.recvInt()
+		if err != nil || available == 0 {
+			return err
+		}
+		ok = true
+		// the interface sends the playlist through the server
+		if err := c.waitFor(evData); err != nil {
+			return err
+		}
+		// serial number of the playlist
+		if _, err := c.recvInt(); err != nil {
+			return err
+		}
+		items, err = c.recvItems()
+		return err
+	})
+	return items, ok, err
+}
+
+func (c *MocClient) GetQueue() ([]MocItem, error) {
+	var items []MocItem
+	err := c.request(func() error {
+		if err := c.sendInt(cmdGetQueue); err != nil {
+			return err
+		}
+		if err := c.waitFor(evData); err != nil {
+			return err
+		}
+		var err error
+		items, err = c.recvItems()
+		return err
+	})
+	return items, err
+}
+
+// GetFileName returns the file (or stream URL) currently played
+func (c *MocClient) GetFileName() (string, error) {
+	var file string
+	err := c.request(func() error {
+		if err := c.sendInt(cmdGetSName); err != nil {
+			return err
+		}
+		if err := c.waitFor(evData); err != nil {
+			return err
+		}
+		var err error
+		file, err = c.recvStr()
+		return err
+	})
+	return file, err
+}
+
+// GetTags returns the tags of the file currently played
+func (c *MocClient) GetTags() (MocTags, error) {
+	var tags MocTags
+	err := c.request(func() error {
+		if err := c.sendInt(cmdGetTags); err != nil {
+			return err
+		}
+		if err := c.waitFor(evData); err != nil {
+			return err
+		}
+		var err error
+		tags, err = c.recvTags()
+		return err
+	})
+	return tags, err
+}
+
+// Info returns the same fields printed by `mocp -i`, formatted the
+// same way, so that they can be parsed by MocP.UpdateInfo.
+func (c *MocClient) Info() (map[string]string, error) {
+	info := make(map[string]string)
+	state, err := c.GetState()
+	if err != nil {
+		return nil, err
+	}
+	switch state {
+	case statePlay:
+		info[State] = "PLAY"
+	case statePause:
+		info[State] = "PAUSE"
+	default:
+		info[State] = "STOP"
+		return info, nil
+	}
+
+	file, err := c.GetFileName()
+	if err != nil {
+		return nil, err
+	}
+	if file == "" {
+		return info, nil
+	}
+	tags, err := c.GetTags()
+	if err != nil {
+		return nil, err
+	}
+	ctime, err := c.GetCTime()
+	if err != nil {
+		return nil, err
+	}
+	bitrate, err := c.GetBitrate()
+	if err != nil {
+		return nil, err
+	}
+	avgBitrate, err := c.GetAvgBitrate()
+	if err != nil {
+		return nil, err
+	}
+	rate, err := c.GetRate()
+	if err != nil {
+		return nil, err
+	}
+
+	info[File] = file
+	info[Title] = formatTitle(file, tags)
+	if tags.Artist != "" {
+		info[Artist] = tags.Artist
+	}
+	if tags.Title != "" {
+		info[SongTitle] = tags.Title
+	}
+	if tags.Album != "" {
+		info[Album] = tags.Album
+	}
+	if tags.Time >= 0 {
+		info[TotalTime] = formatSeconds(tags.Time)
+		info[TotalSec] = strconv.Itoa(tags.Time)
+		info[TimeLeft] = formatSeconds(max(tags.Time-ctime, 0))
+	}
+	info[CurrentTime] = formatSeconds(ctime)
+	info[CurrentSec] = strconv.Itoa(ctime)
+	info[Bitrate] = fmt.Sprintf("%dkbps", bitrate)
+	info[AvgBitrate] = fmt.Sprintf("%dkbps", avgBitrate)
+	info[Rate] = fmt.Sprintf("%dkHz", rate)
+
+	return info, nil
+}
+
+// Protocol
+
+// command sends a command with its arguments; no response is expected
+func (c *MocClient) command(args ...any) error {
+	return c.request(func() error {
+		return c.send(args...)
+	})
+}
+
+func (c *MocClient) requestInt(cmd int) (int, error) {
+	var val int
+	err := c.request(func() error {
+		if err := c.sendInt(cmd); err != nil {
+			return err
+		}
+		if err := c.waitFor(evData); err != nil {
+			return err
+		}
+		var err error
+		val, err = c.recvInt()
+		return err
+	})
+	return val, err
+}
+
+func (c *MocClient) request(exchange func() error) error {
+	if c == nil {
+		return errors.New("not connected to the MOC server")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.conn.SetDeadline(time.Now().Add(mocRequestTimeout)); err != nil {
+		return err
+	}
+	return exchange()
+}
+
+// waitFor reads events until event arrives, skipping the
+// unrelated events the server broadcasts to every client
+func (c *MocClient) waitFor(event int) error {
+	for {
+		ev, err := c.recvInt()
+		if err != nil {
+			return err
+		}
+		if ev == event {
+			return nil
+		}
+		switch ev {
+		case evExit:
+			return errors.New("MOC server is exiting")
+		case evSrvError:
+			msg, err := c.recvStr()
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("MOC server error: %s", msg)
+		}
+		if err := c.skipEventData(ev); err != nil {
+			return err
+		}
+	}
+}
+
+// skipEventData consumes the payload carried by some events
+func (c *MocClient) skipEventData(ev int) error {
+	switch ev {
+	case evPlistAdd, evQueueAdd:
+		return c.skipItem()
+	case evPlistDel, evQueueDel, evStatusMsg, evSrvError:
+		_, err := c.recvStr()
+		return err
+	case evPlistMove, evQueueMove:
+		if _, err := c.recvStr(); err != nil {
+			return err
+		}
+		_, err := c.recvStr()
+		return err
+	case evFileTags:
+		if _, err := c.recvStr(); err != nil {
+			return err
+		}
+		_, err := c.recvTags()
+		return err
+	}
+	return nil
+}
+
+func (c *MocClient) skipItem() error {
+	_, err := c.recvItem()
+	return err
+}
+
+// recvItems reads items until the empty one ending the list
+func (c *MocClient) recvItems() ([]MocItem, error) {
+	var items []MocItem
+	for {
+		item, err := c.recvItem()
+		if err != nil {
+			return nil, err
+		}
+		if item.File == "" {
+			return items, nil
+		}
+		items = append(items, item)
+	}
+}
+
+func (c *MocClient) recvItem() (MocItem, error) {
+	var item MocItem
+	var err error
+	if item.File, err = c.recvStr(); err != nil || item.File == "" {
+		return item, err
+	}
+	if item.TitleTags, err = c.recvStr(); err != nil {
+		return item, err
+	}
+	if item.Tags, err = c.recvTags(); err != nil {
+		return item, err
+	}
+	// mtime is a time_t
+	_, err = io.ReadFull(c.conn, make([]byte, 8))
+	return item, err
+}
+
+func (c *MocClient) send(args ...any) error {
+	for _, arg := range args {
+		var err error
+		switch v := arg.(type) {
+		case int:
+			err = c.sendInt(v)
+		case string:
+			err = c.sendStr(v)
+		default:
+			err = fmt.Errorf("cannot send %T to the MOC server", arg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *MocClient) sendInt(val int) error {
+	buf := binary.NativeEndian.AppendUint32(nil, uint32(int32(val)))
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (c *MocClient) sendStr(val string) error {
+	buf := binary.NativeEndian.AppendUint32(nil, uint32(len(val)))
+	buf = append(buf, val...)
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (c *MocClient) recvInt() (int, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c.conn, buf); err != nil {
+		return 0, err
+	}
+	return int(int32(binary.NativeEndian.Uint32(buf))), nil
+}
+
+func (c *MocClient) recvStr() (string, error) {
+	length, err := c.recvInt()
+	if err != nil {
+		return "", err
+	}
+	if length < 0 || length > mocMaxStrLen {
+		return "", fmt.Errorf("invalid string length %d from the MOC server", length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(c.conn, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (c *MocClient) recvTags() (MocTags, error) {
+	var tags MocTags
+	var err error
+	if tags.Title, err = c.recvStr(); err != nil {
+		return tags, err
+	}
+	if tags.Artist, err = c.recvStr(); err != nil {
+		return tags, err
+	}
+	if tags.Album, err = c.recvStr(); err != nil {
+		return tags, err
+	}
+	if tags.Track, err = c.recvInt(); err != nil {
+		return tags, err
+	}
+	if tags.Time, err = c.recvInt(); err != nil {
+		return tags, err
+	}
+	// filled flags, unused
+	_, err = c.recvInt()
+	return tags, err
+}
+
+func isPlaylistEvent(ev int) bool {
+	switch ev {
+	case evPlistAdd, evPlistDel, evPlistMove, evPlistClear,
+		evQueueAdd, evQueueDel, evQueueMove, evQueueClear:
+		return true
+	}
+	return false
+}
+
+// formatTitle mimics the default FormatString of mocp
+func formatTitle(file string, tags MocTags) string {
+	if tags.Title == "" {
+		return filepath.Base(file)
+	}
+	var b strings.Builder
+	if tags.Track > 0 {
+		fmt.Fprintf(&b, "%d ", tags.Track)
+	}
+	if tags.Artist != "" {
+		fmt.Fprintf(&b, "%s - ", tags.Artist)
+	}
+	b.WriteString(tags.Title)
+	if tags.Album != "" {
+		fmt.Fprintf(&b, " (%s)", tags.Album)
+	}
+	return b.String()
+}
+
+// formatSeconds formats seconds as MM:SS, like mocp -i does
+func formatSeconds(seconds int) string {
+	return fmt.Sprintf("%02d:%02d", seconds/60, seconds%60)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var supportedUriSchemes = []string{"file", "http", "https"}
+
+var supportedMimeTypes = []string{
+	"audio/mpeg",
+	"audio/ogg",
+	"audio/vorbis",
+	"audio/opus",
+	"audio/flac",
+	"audio/x-flac",
+	"audio/wav",
+	"audio/x-wav",
+	"audio/aiff",
+	"audio/x-aiff",
+	"audio/mp4",
+	"audio/aac",
+	"audio/x-m4a",
+	"audio/x-ms-wma",
+	"audio/x-musepack",
+	"audio/x-wavpack",
+	"audio/x-speex",
+	"audio/x-mpegurl",
+	"audio/x-scpls",
+}
+
+// extensions of the files MOC can decode
+var audioExtensions = map[string]bool{
+	".mp3":  true,
+	".ogg":  true,
+	".oga":  true,
+	".opus": true,
+	".flac": true,
+	".wav":  true,
+	".aif":  true,
+	".aiff": true,
+	".au":   true,
+	".snd":  true,
+	".m4a":  true,
+	".mp4":  true,
+	".aac":  true,
+	".wma":  true,
+	".mpc":  true,
+	".wv":   true,
+	".spx":  true,
+}
+
+// resolveUri turns a URI handed to OpenUri into the list of files or
+// streams to append to the playlist. Directories are walked and
+// playlist files are expanded.
+func resolveUri(uri string) ([]string, error) {
+	if isStream(uri) {
+		return []string{uri}, nil
+	}
+	path, err := uriToPath(uri)
+	if err != nil {
+		return nil, err
+	}
+	return expandPath(path)
+}
+
+func isStream(uri string) bool {
+	lower := strings.ToLower(uri)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// uriToPath percent-decodes file:// URIs; anything else without a
+// scheme is taken as a plain path
+func uriToPath(uri string) (string, error) {
+	if !strings.Contains(uri, "://") {
+		return filepath.Abs(uri)
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported URI scheme %q", u.Scheme)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("remote file URI %q is not supported", uri)
+	}
+	return u.Path, nil
+}
+
+func expandPath(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return walkAudioFiles(path)
+	}
+	if isPlaylist(path) {
+		return readPlaylist(path)
+	}
+	return []string{path}, nil
+}
+
+// walkAudioFiles lists the audio files under dir, in lexical order
+func walkAudioFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && audioExtensions[strings.ToLower(filepath.Ext(path))] {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no audio files in %s", dir)
+	}
+	return files, nil
+}
+
+func isPlaylist(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".m3u", ".m3u8", ".pls":
+		return true
+	}
+	return false
+}
+
+// readPlaylist returns the entries of a m3u or pls playlist. Relative
+// entries are resolved against the playlist's directory.
+func readPlaylist(path string) ([]string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var entries []string
+	if strings.ToLower(filepath.Ext(path)) == ".pls" {
+		entries, err = parsePls(bufio.NewScanner(fd))
+	} else {
+		entries, err = parseM3u(bufio.NewScanner(fd))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(path)
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		switch {
+		case isStream(entry):
+			files = append(files, entry)
+		case strings.HasPrefix(entry, "file://"):
+			file, err := uriToPath(entry)
+			if err != nil {
+				continue
+			}
+			files = append(files, file)
+		case filepath.IsAbs(entry):
+			files = append(files, entry)
+		default:
+			files = append(files, filepath.Join(dir, entry))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("playlist %s is empty", path)
+	}
+	return files, nil
+}
+
+func parseM3u(scanner *bufio.Scanner) ([]string, error) {
+	var entries []string
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries, scanner.Err()
+}
+
+func parsePls(scanner *bufio.Scanner) ([]string, error) {
+	type plsEntry struct {
+		index int
+		file  string
+	}
+	var entries []plsEntry
+	for scanner.Scan() {
+		key, val, ok := strings.Cut(scanner.Text(), "=")
+		key = strings.TrimSpace(key)
+		if !ok || !strings.HasPrefix(strings.ToLower(key), "file") {
+			continue
+		}
+		index, err := strconv.Atoi(key[len("file"):])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, plsEntry{index, strings.TrimSpace(val)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no entries in pls playlist")
+	}
+	slices.SortStableFunc(entries, func(a, b plsEntry) int {
+		return a.index - b.index
+	})
+	files := make([]string, len(entries))
+	for i, e := range entries {
+		files[i] = e.file
+	}
+	return files, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseM3u(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"plain", "a.mp3\nb.mp3\n", []string{"a.mp3", "b.mp3"}},
+		{"extended", "#EXTM3U\n#EXTINF:123,Artist - Title\n/music/a.mp3\n\n#EXTINF:-1,Radio\nhttp://radio/stream\n", []string{"/music/a.mp3", "http://radio/stream"}},
+		{"bom and crlf", "\ufeff#EXTM3U\r\na.mp3\r\n  b.mp3  \r\n", []string{"a.mp3", "b.mp3"}},
+		{"empty", "#EXTM3U\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseM3u(bufio.NewScanner(strings.NewReader(tt.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePls(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{"ordered", "[playlist]\nFile1=a.mp3\nTitle1=A\nFile2=b.mp3\nNumberOfEntries=2\nVersion=2\n", []string{"a.mp3", "b.mp3"}, false},
+		{"out of order", "[playlist]\nFile10=c.mp3\nFile2=b.mp3\nfile1 = a.mp3 \n", []string{"a.mp3", "b.mp3", "c.mp3"}, false},
+		{"bad index", "[playlist]\nFileX=x.mp3\nFile1=a.mp3\n", []string{"a.mp3"}, false},
+		{"empty", "[playlist]\nNumberOfEntries=0\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePls(bufio.NewScanner(strings.NewReader(tt.data)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUriToPath(t *testing.T) {
+	relative, err := filepath.Abs("music/a.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		uri     string
+		want    string
+		wantErr bool
+	}{
+		{"file:///music/a%20b.mp3", "/music/a b.mp3", false},
+		{"file://localhost/music/a.mp3", "/music/a.mp3", false},
+		{"file:///music/%C3%A9t%C3%A9.flac", "/music/été.flac", false},
+		{"/music/a b.mp3", "/music/a b.mp3", false},
+		{"music/a.mp3", relative, false},
+		{"file://server/music/a.mp3", "", true},
+		{"smb://server/music/a.mp3", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			got, err := uriToPath(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
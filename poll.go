@@ -0,0 +1,78 @@
+package main
+
+import "time"
+
+const (
+	// polling right after a command, to show its effect quickly
+	burstInterval = 250 * time.Millisecond
+	burstDuration = 2 * time.Second
+	// with server events, polling while playing is only a safety net
+	safetyInterval = 10 * time.Second
+	// the poll at the end of a track lands just after MOC moved on;
+	// MOC rounds the time left down to the second
+	trackEndMargin = 500 * time.Millisecond
+)
+
+// poller decides when the loop polls MOC next: often right after a
+// command, every interval while playing, and less and less often while
+// MOC is paused, stopped or not running.
+type poller struct {
+	interval    time.Duration
+	maxInterval time.Duration
+	idle        time.Duration
+	burstUntil  time.Time
+}
+
+func newPoller(cfg *Config) *poller {
+	p := &poller{}
+	p.configure(cfg)
+	return p
+}
+
+// configure applies the polling options of cfg
+func (p *poller) configure(cfg *Config) {
+	p.interval = cfg.PollInterval
+	p.maxInterval = cfg.MaxPollInterval
+	p.idle = 0
+}
+
+// burst makes the next polls fast, after a command
+func (p *poller) burst() {
+	p.burstUntil = time.Now().Add(burstDuration)
+	p.idle = 0
+}
+
+// bursting tells whether the polls are the fast ones after a command
+func (p *poller) bursting() bool {
+	return time.Now().Before(p.burstUntil)
+}
+
+// wake stops backing off, when MOC did something
+func (p *poller) wake() {
+	p.idle = 0
+}
+
+// next returns how long to wait before polling again. While playing,
+// the poll is moved up to the end of the track when timeLeft is known.
+func (p *poller) next(playing bool, timeLeft time.Duration, hasEnd bool, events bool) time.Duration {
+	if p.bursting() {
+		return burstInterval
+	}
+	interval := p.interval
+	if events {
+		interval = max(interval, min(safetyInterval, p.maxInterval))
+	}
+	if !playing {
+		if p.idle == 0 {
+			p.idle = interval
+		} else {
+			p.idle = min(2*p.idle, p.maxInterval)
+		}
+		return p.idle
+	}
+	p.idle = 0
+	if hasEnd {
+		interval = min(interval, timeLeft+trackEndMargin)
+	}
+	return interval
+}
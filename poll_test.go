@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPollerNext(t *testing.T) {
+	type poll struct {
+		playing  bool
+		timeLeft time.Duration
+		hasEnd   bool
+		events   bool
+		want     time.Duration
+	}
+	stopped := func(want time.Duration) poll { return poll{want: want} }
+	playing := func(want time.Duration) poll { return poll{playing: true, want: want} }
+
+	tests := []struct {
+		name  string
+		max   time.Duration
+		burst time.Duration
+		polls []poll
+	}{
+		{"backoff doubles up to the max", 8 * time.Second, 0, []poll{
+			stopped(time.Second), stopped(2 * time.Second), stopped(4 * time.Second),
+			stopped(8 * time.Second), stopped(8 * time.Second),
+		}},
+		{"playing stops the backoff", time.Minute, 0, []poll{
+			stopped(time.Second), stopped(2 * time.Second),
+			playing(time.Second), stopped(time.Second),
+		}},
+		{"events make playing polls a safety net", time.Minute, 0, []poll{
+			{playing: true, events: true, want: safetyInterval},
+		}},
+		{"the safety net stays under the max", 5 * time.Second, 0, []poll{
+			{playing: true, events: true, want: 5 * time.Second},
+		}},
+		{"the end of the track comes first", time.Minute, 0, []poll{
+			{playing: true, timeLeft: 300 * time.Millisecond, hasEnd: true, want: 300*time.Millisecond + trackEndMargin},
+			{playing: true, timeLeft: time.Minute, hasEnd: true, events: true, want: safetyInterval},
+		}},
+		{"the time left of streams is ignored", time.Minute, 0, []poll{
+			{playing: true, timeLeft: 0, hasEnd: false, want: time.Second},
+		}},
+		{"burst", time.Minute, time.Second, []poll{
+			stopped(burstInterval), playing(burstInterval),
+		}},
+		{"expired burst", time.Minute, -time.Millisecond, []poll{
+			stopped(time.Second), playing(time.Second),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.PollInterval = time.Second
+			cfg.MaxPollInterval = tt.max
+			p := newPoller(cfg)
+			if tt.burst != 0 {
+				p.burstUntil = time.Now().Add(tt.burst)
+			}
+			for i, poll := range tt.polls {
+				got := p.next(poll.playing, poll.timeLeft, poll.hasEnd, poll.events)
+				if got != poll.want {
+					t.Errorf("poll %d: got %v, want %v", i, got, poll.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPollerWake(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PollInterval = time.Second
+	cfg.MaxPollInterval = time.Minute
+	p := newPoller(cfg)
+	p.next(false, 0, false, false)
+	p.next(false, 0, false, false)
+	p.wake()
+	if got := p.next(false, 0, false, false); got != time.Second {
+		t.Errorf("after wake, got %v, want %v", got, time.Second)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// positions further than this from the extrapolated one are seeks
+const seekedTolerance = 1500 * time.Millisecond
+
+// positionClock extrapolates the position of the current track between
+// the updates of MOC, which only reports whole seconds. It is read by
+// the D-Bus goroutines when clients get Position, and anchored by the
+// loop.
+type positionClock struct {
+	mu       sync.Mutex
+	anchor   time.Time
+	position int64
+	playing  bool
+	length   int64
+}
+
+// Position returns the position in microseconds: the anchored one,
+// plus the time elapsed since while playing
+func (c *positionClock) Position() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	position := c.position
+	if c.playing {
+		// time.Since uses the monotonic clock
+		position += time.Since(c.anchor).Microseconds()
+	}
+	if c.length > 0 {
+		position = min(position, c.length)
+	}
+	return position
+}
+
+// Set anchors the clock at position, now
+func (c *positionClock) Set(position int64, playing bool, length int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.anchor = time.Now()
+	c.position = position
+	c.playing = playing
+	c.length = length
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPositionClock(t *testing.T) {
+	tests := []struct {
+		name     string
+		position int64
+		playing  bool
+		length   int64
+		elapsed  time.Duration
+		want     int64
+	}{
+		{"paused", 5000000, false, 60000000, 2 * time.Second, 5000000},
+		{"playing", 5000000, true, 60000000, 2 * time.Second, 7000000},
+		{"capped at the length", 59000000, true, 60000000, 2 * time.Second, 60000000},
+		{"stream without a length", 5000000, true, 0, 2 * time.Second, 7000000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c positionClock
+			c.Set(tt.position, tt.playing, tt.length)
+			c.anchor = c.anchor.Add(-tt.elapsed)
+			// a little time passes between Set and Position
+			if got := c.Position(); got < tt.want || got > tt.want+100000 {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+// Properties serves org.freedesktop.DBus.Properties on top of the
+// godbus implementation, answering with the standard D-Bus errors
+// instead of the godbus ones, so that clients can tell a read-only
+// property from a failed write. Properties with a getter are computed
+// when they are read. Writes only call the callback of the property,
+// which is in charge of publishing the new value.
+//
+// The values are kept here rather than by godbus, whose SetMust panics
+// when the bus fails: publish returns the error instead.
+type Properties struct {
+	*prop.Properties
+	conn    *dbus.Conn
+	path    dbus.ObjectPath
+	props   prop.Map
+	getters map[string]map[string]func() any
+
+	mu     sync.RWMutex
+	values map[string]map[string]any
+}
+
+// exportProperties exports props on path, replacing the handler
+// prop.Export registers
+func exportProperties(conn *dbus.Conn, path dbus.ObjectPath, props prop.Map, getters map[string]map[string]func() any) (*Properties, error) {
+	properties, err := prop.Export(conn, path, props)
+	if err != nil {
+		return nil, err
+	}
+	p := &Properties{Properties: properties, conn: conn, path: path, props: props, getters: getters}
+	p.values = make(map[string]map[string]any)
+	for iface, ifaceProps := range props {
+		p.values[iface] = make(map[string]any)
+		for property, current := range ifaceProps {
+			p.values[iface][property] = current.Value
+		}
+	}
+	err = conn.Export(p, path, "org.freedesktop.DBus.Properties")
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Properties) Get(iface, property string) (dbus.Variant, *dbus.Error) {
+	if err := p.check(iface, property); err != nil {
+		return dbus.Variant{}, err
+	}
+	if get, ok := p.getters[iface][property]; ok {
+		return dbus.MakeVariant(get()), nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return dbus.MakeVariant(p.values[iface][property]), nil
+}
+
+func (p *Properties) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	if _, ok := p.props[iface]; !ok {
+		return nil, unknownInterface(iface)
+	}
+	values := make(map[string]dbus.Variant)
+	p.mu.RLock()
+	for property, value := range p.values[iface] {
+		values[property] = dbus.MakeVariant(value)
+	}
+	p.mu.RUnlock()
+	for property, get := range p.getters[iface] {
+		values[property] = dbus.MakeVariant(get())
+	}
+	return values, nil
+}
+
+func (p *Properties) Set(iface, property string, value dbus.Variant) *dbus.Error {
+	if err := p.check(iface, property); err != nil {
+		return err
+	}
+	// godbus works on a copy of props, these only tell the types and
+	// writability, which never change
+	current := p.props[iface][property]
+	if !current.Writable || current.Callback == nil {
+		return dbus.NewError("org.freedesktop.DBus.Error.PropertyReadOnly",
+			[]any{fmt.Sprintf("%s.%s is read-only", iface, property)})
+	}
+	if value.Signature() != dbus.SignatureOf(current.Value) {
+		return dbus.NewError("org.freedesktop.DBus.Error.InvalidArgs",
+			[]any{fmt.Sprintf("%s.%s has type %s, not %s", iface, property, dbus.SignatureOf(current.Value), value.Signature())})
+	}
+	// godbus would run the callback holding the lock of the properties:
+	// the callback waits for the loop, which may be publishing
+	return current.Callback(&prop.Change{Props: p.Properties, Iface: iface, Name: property, Value: value.Value()})
+}
+
+func (p *Properties) check(iface, property string) *dbus.Error {
+	props, ok := p.props[iface]
+	if !ok {
+		return unknownInterface(iface)
+	}
+	if _, ok := props[property]; !ok {
+		return dbus.NewError("org.freedesktop.DBus.Error.UnknownProperty",
+			[]any{fmt.Sprintf("no property %s on %s", property, iface)})
+	}
+	return nil
+}
+
+func unknownInterface(iface string) *dbus.Error {
+	return dbus.NewError("org.freedesktop.DBus.Error.UnknownInterface",
+		[]any{fmt.Sprintf("no interface %s", iface)})
+}
+
+// publish stores value as the new value of property, and announces it
+// with PropertiesChanged
+func (p *Properties) publish(iface, property string, value any) error {
+	current, ok := p.props[iface][property]
+	if !ok {
+		return fmt.Errorf("no property %s on %s", property, iface)
+	}
+	if dbus.SignatureOf(value) != dbus.SignatureOf(current.Value) {
+		return fmt.Errorf("%s.%s has type %s, not %s", iface, property, dbus.SignatureOf(current.Value), dbus.SignatureOf(value))
+	}
+	p.mu.Lock()
+	p.values[iface][property] = value
+	p.mu.Unlock()
+
+	switch current.Emit {
+	case prop.EmitTrue:
+		return p.conn.Emit(p.path, "org.freedesktop.DBus.Properties.PropertiesChanged",
+			iface, map[string]dbus.Variant{property: dbus.MakeVariant(value)}, []string{})
+	case prop.EmitInvalidates:
+		return p.conn.Emit(p.path, "org.freedesktop.DBus.Properties.PropertiesChanged",
+			iface, map[string]dbus.Variant{}, []string{property})
+	}
+	return nil
+}
+
+// publishChanged publishes the values that differ from last, recording
+// them there, and returns the names of the properties that changed. A
+// value that failed to publish is tried again by the next call.
+func (p *Properties) publishChanged(iface string, last, values map[string]any) ([]string, error) {
+	var changed []string
+	for property, value := range values {
+		if reflect.DeepEqual(value, last[property]) {
+			continue
+		}
+		if err := p.publish(iface, property, value); err != nil {
+			return changed, err
+		}
+		last[property] = value
+		changed = append(changed, property)
+	}
+	slices.Sort(changed)
+	return changed, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// serverState is what the bridge knows of the MOC server
+type serverState int
+
+const (
+	// nothing listens on the socket
+	serverAbsent serverState = iota
+	// the server answers
+	serverConnected
+	// the server listens, but reading its state fails
+	serverFailed
+)
+
+func (s serverState) String() string {
+	switch s {
+	case serverAbsent:
+		return "absent"
+	case serverConnected:
+		return "connected"
+	case serverFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("serverState(%d)", int(s))
+}
+
+// Server returns the state of the MOC server
+func (mp *MocP) Server() serverState {
+	if mp == nil {
+		return serverAbsent
+	}
+	return mp.server
+}
+
+// setServer moves the server to state, logging the transitions
+func (mp *MocP) setServer(state serverState) {
+	if state == mp.server {
+		return
+	}
+	log.Printf("MOC server: %s -> %s", mp.server, state)
+	mp.server = state
+}
+
+// serverGone updates the state of the server after reading it failed.
+// It tells whether the server is gone, rather than failing.
+func (mp *MocP) serverGone() bool {
+	if serverListening() {
+		mp.setServer(serverFailed)
+		return false
+	}
+	mp.setServer(serverAbsent)
+	return true
+}
+
+// ensureServer starts the MOC server when it's down, if the
+// configuration allows it
+func (mp *MocP) ensureServer() error {
+	if !mp.autoStart || mp.server == serverConnected || mp.server == serverFailed {
+		return nil
+	}
+	// a server started behind our back makes mocp -S fail
+	if serverListening() {
+		mp.setServer(serverConnected)
+		return nil
+	}
+	name, args := startCommand()
+	_, err := runCommand(mp.ctx, name, args...)
+	// the server keeps the output of mocp open
+	if errors.Is(err, exec.ErrWaitDelay) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("starting the MOC server: %w", err)
+	}
+	// mocp -S only returns once the server listens
+	if !serverListening() {
+		return errors.New("the MOC server didn't start")
+	}
+	mp.setServer(serverConnected)
+	return nil
+}
+
+// serverListening tells whether something accepts connections on the
+// MOC socket; the socket left behind by a crashed server refuses them
+func serverListening() bool {
+	c, err := NewMocClient(MocSocketPath())
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+// startCommand returns the command starting the MOC server. Under
+// systemd, the server is started in a scope of its own: in the unit of
+// the bridge, it would be killed whenever the bridge stops or restarts.
+func startCommand() (string, []string) {
+	if os.Getenv("INVOCATION_ID") != "" {
+		if _, err := exec.LookPath("systemd-run"); err == nil {
+			return "systemd-run", []string{"--user", "--scope", "--collect", "--quiet", "mocp", "-S"}
+		}
+	}
+	return "mocp", []string{"-S"}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// socketWatch notices the MOC socket being created or removed, with
+// inotify on the MOC directory
+type socketWatch struct {
+	file *os.File
+}
+
+// watchSocket watches path. The channel gets a value when path appears
+// or disappears, and is closed if the directory goes away.
+func watchSocket(path string) (*socketWatch, <-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir, name := filepath.Split(path)
+	mask := uint32(syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO)
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return nil, nil, err
+	}
+	// a non-blocking file is read through the runtime poller, so that
+	// Close interrupts the read
+	w := &socketWatch{file: os.NewFile(uintptr(fd), "inotify")}
+	changes := make(chan struct{}, 1)
+	go w.read(name, changes)
+	return w, changes, nil
+}
+
+func (w *socketWatch) Close() error {
+	if w == nil {
+		return nil
+	}
+	return w.file.Close()
+}
+
+func (w *socketWatch) read(name string, changes chan<- struct{}) {
+	defer close(changes)
+	buf := make([]byte, 4096)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			// struct inotify_event: wd, mask, cookie, len, then the name
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			length := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			start := off + syscall.SizeofInotifyEvent
+			off = start + length
+			if mask&syscall.IN_IGNORED != 0 {
+				return
+			}
+			evName := strings.TrimRight(string(buf[start:min(off, n)]), "\x00")
+			if evName == name || mask&syscall.IN_Q_OVERFLOW != 0 {
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// socketWatch needs inotify; elsewhere the bridge only polls
+type socketWatch struct{}
+
+func watchSocket(path string) (*socketWatch, <-chan struct{}, error) {
+	return nil, nil, errors.New("watching the MOC socket needs inotify")
+}
+
+func (w *socketWatch) Close() error {
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dhowden/tag"
+)
+
+// FileTags are the tags read from the file itself, beyond what MOC
+// reports
+type FileTags struct {
+	TrackNumber  int
+	DiscNumber   int
+	Artists      []string
+	Genres       []string
+	AlbumArtists []string
+	Composers    []string
+	Year         int
+	Album        string
+	Comment      string
+	Lyrics       string
+	ArtURI       string
+
+	// embedded picture, until it's handed to the art cache
+	picture *tag.Picture
+}
+
+// readFileTags reads the tags of file. Streams and files without
+// tags give empty tags. Multi-valued fields are split on separators,
+// unless the tag already stores separate values.
+func readFileTags(file string, separators []string) FileTags {
+	var tags FileTags
+	fd, err := os.Open(file)
+	if err != nil {
+		return tags
+	}
+	defer fd.Close()
+
+	m, err := tag.ReadFrom(fd)
+	if err != nil {
+		return tags
+	}
+
+	tags.TrackNumber, _ = m.Track()
+	tags.DiscNumber, _ = m.Disc()
+	tags.Artists = splitValues(m.Artist(), separators)
+	tags.Genres = splitValues(m.Genre(), separators)
+	tags.AlbumArtists = splitValues(m.AlbumArtist(), separators)
+	tags.Composers = splitValues(m.Composer(), separators)
+	if m.Format() == tag.ID3v2_4 {
+		frames := readID3v24TextFrames(file, "TPE1", "TCON", "TPE2", "TCOM")
+		for id, field := range map[string]*[]string{
+			"TPE1": &tags.Artists,
+			"TCON": &tags.Genres,
+			"TPE2": &tags.AlbumArtists,
+			"TCOM": &tags.Composers,
+		} {
+			if values := frames[id]; len(values) > 1 {
+				*field = values
+			}
+		}
+	}
+	tags.Year = m.Year()
+	tags.Comment = m.Comment()
+	tags.Lyrics = m.Lyrics()
+	tags.Album = m.Album()
+	tags.picture = frontCover(embeddedPictures(file, m))
+
+	return tags
+}
+
+// metadata adds the tags to MPRIS metadata, with the xesam types
+func (t FileTags) metadata(metadata map[string]any) {
+	if t.TrackNumber > 0 {
+		metadata["xesam:trackNumber"] = int32(t.TrackNumber)
+	}
+	if t.DiscNumber > 0 {
+		metadata["xesam:discNumber"] = int32(t.DiscNumber)
+	}
+	if len(t.Artists) > 0 {
+		metadata["xesam:artist"] = t.Artists
+	}
+	if len(t.Genres) > 0 {
+		metadata["xesam:genre"] = t.Genres
+	}
+	if len(t.AlbumArtists) > 0 {
+		metadata["xesam:albumArtist"] = t.AlbumArtists
+	}
+	if len(t.Composers) > 0 {
+		metadata["xesam:composer"] = t.Composers
+	}
+	if t.Year > 0 {
+		metadata["xesam:contentCreated"] = fmt.Sprintf("%04d-01-01T00:00:00Z", t.Year)
+	}
+	if t.Comment != "" {
+		metadata["xesam:comment"] = []string{t.Comment}
+	}
+	if t.Lyrics != "" {
+		metadata["xesam:asText"] = t.Lyrics
+	}
+	if t.ArtURI != "" {
+		metadata["mpris:artUrl"] = t.ArtURI
+	}
+}
+
+// splitValues splits a tag holding several values. Null characters
+// always separate values.
+func splitValues(value string, separators []string) []string {
+	values := []string{value}
+	for _, sep := range append([]string{"\x00"}, separators...) {
+		var split []string
+		for _, v := range values {
+			split = append(split, strings.Split(v, sep)...)
+		}
+		values = split
+	}
+
+	result := values[:0]
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
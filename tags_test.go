@@ -0,0 +1,28 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitValues(t *testing.T) {
+	tests := []struct {
+		value      string
+		separators []string
+		want       []string
+	}{
+		{"Artist", nil, []string{"Artist"}},
+		{"", nil, nil},
+		{"  ", []string{";"}, nil},
+		{"A\x00B", nil, []string{"A", "B"}},
+		{"A; B;C", []string{";"}, []string{"A", "B", "C"}},
+		{"A feat. B / C", []string{" feat. ", "/"}, []string{"A", "B", "C"}},
+		{"A;;B;", []string{";"}, []string{"A", "B"}},
+		{"A & B", []string{";"}, []string{"A & B"}},
+	}
+	for _, tt := range tests {
+		if got := splitValues(tt.value, tt.separators); !slices.Equal(got, tt.want) {
+			t.Errorf("splitValues(%q, %q) = %q, want %q", tt.value, tt.separators, got, tt.want)
+		}
+	}
+}
@@ -5,11 +5,19 @@ import (
 	"github.com/godbus/dbus/v5/prop"
 )
 
+// newProp makes a property that emits its changes. Only properties
+// with a callback can be set by clients.
 func newProp(value any, cb func(*prop.Change) *dbus.Error) *prop.Prop {
 	return &prop.Prop{
 		Value:    value,
-		Writable: true,
+		Writable: cb != nil,
 		Emit:     prop.EmitTrue,
 		Callback: cb,
 	}
 }
+
+// toSeconds rounds a non-negative position in microseconds to the
+// nearest second, the precision of MOC
+func toSeconds(microseconds int64) int {
+	return int((microseconds + 500000) / 1000000)
+}